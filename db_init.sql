@@ -2,5 +2,99 @@ CREATE TABLE `subscriptions` (
   `conv_id` char(64) NOT NULL,
   `repo` varchar(128) NOT NULL,
   `oauth_identifier` varchar(128) NOT NULL,
-  UNIQUE KEY unique_subscription (`conv_id`, `repo`)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
+  `events` varchar(255) NOT NULL DEFAULT '',
+  `branches` varchar(255) NOT NULL DEFAULT '',
+  `hook_id` bigint NOT NULL DEFAULT 0,
+  `labels` varchar(255) NOT NULL DEFAULT '',
+  `repo_id` bigint NOT NULL DEFAULT 0,
+  `secret_repo` varchar(128) NOT NULL DEFAULT '',
+  UNIQUE KEY unique_subscription (`conv_id`, `repo`),
+  KEY subscriptions_by_repo_id (`repo_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `delivery_queue` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `conv_id` char(64) NOT NULL,
+  `message` text NOT NULL,
+  `repo` varchar(128) NOT NULL DEFAULT '',
+  `item_index` bigint NOT NULL DEFAULT 0,
+  `card` text NOT NULL,
+  `pr_sync` text NOT NULL,
+  `attempts` int NOT NULL DEFAULT 0,
+  `next_attempt_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `dead` boolean NOT NULL DEFAULT false,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY pending_deliveries (`dead`, `next_attempt_at`),
+  KEY conv_deliveries (`conv_id`, `dead`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `webhook_deliveries` (
+  `conv_id` char(64) NOT NULL,
+  `delivery_id` varchar(64) NOT NULL,
+  `received_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`conv_id`, `delivery_id`),
+  KEY received_deliveries (`conv_id`, `received_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `user_tokens` (
+  `username` varchar(128) NOT NULL,
+  `token` varchar(255) NOT NULL,
+  PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `issue_state` (
+  `repo` varchar(128) NOT NULL,
+  `item_index` bigint NOT NULL,
+  `head_sha` varchar(64) NOT NULL DEFAULT '',
+  `labels` varchar(1024) NOT NULL DEFAULT '',
+  `milestone` varchar(255) NOT NULL DEFAULT '',
+  `assignees` varchar(1024) NOT NULL DEFAULT '',
+  PRIMARY KEY (`repo`, `item_index`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `branch_heads` (
+  `repo` varchar(128) NOT NULL,
+  `branch` varchar(191) NOT NULL,
+  `head_sha` varchar(64) NOT NULL,
+  PRIMARY KEY (`repo`, `branch`),
+  KEY branch_heads_by_sha (`repo`, `head_sha`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `commit_status_state` (
+  `repo` varchar(128) NOT NULL,
+  `branch` varchar(191) NOT NULL,
+  `context` varchar(128) NOT NULL,
+  `outcome` varchar(16) NOT NULL,
+  PRIMARY KEY (`repo`, `branch`, `context`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `chat_messages` (
+  `conv_id` char(64) NOT NULL,
+  `repo` varchar(128) NOT NULL,
+  `item_index` bigint NOT NULL,
+  `msg_id` bigint unsigned NOT NULL,
+  `card` boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (`conv_id`, `repo`, `item_index`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `conv_templates` (
+  `conv_id` char(64) NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `template` text NOT NULL,
+  PRIMARY KEY (`conv_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `conv_settings` (
+  `conv_id` char(64) NOT NULL,
+  `style` varchar(16) NOT NULL DEFAULT 'normal',
+  PRIMARY KEY (`conv_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `repo_state` (
+  `repo_id` bigint NOT NULL,
+  `archived` boolean NOT NULL DEFAULT false,
+  `private` boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (`repo_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
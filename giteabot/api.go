@@ -0,0 +1,220 @@
+package giteabot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gitea "code.gitea.io/gitea/modules/structs"
+)
+
+// APIClient is a minimal client for the parts of the Gitea REST API the bot
+// uses. Requests are authenticated with token when it is set.
+//
+// The API is documented at https://try.gitea.io/api/swagger
+type APIClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func NewAPIClient(giteaURL string, token string) *APIClient {
+	return &APIClient{
+		baseURL: strings.TrimSuffix(giteaURL, "/") + "/api/v1",
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// APIError is returned for any non-2xx response from Gitea.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("gitea API returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("gitea API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the Gitea API.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsForbidden reports whether err is a 401 or 403 from the Gitea API.
+func IsForbidden(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+func (c *APIClient) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		resBody, _ := ioutil.ReadAll(res.Body)
+		_ = json.Unmarshal(resBody, &apiErr)
+		return &APIError{StatusCode: res.StatusCode, Message: apiErr.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// hooksPath returns the API path for the webhooks of repo. Patterns like
+// "owner/*" use the webhooks of the owning organization.
+func hooksPath(repo string) string {
+	if IsRepoPattern(repo) {
+		return fmt.Sprintf("/orgs/%s/hooks", url.PathEscape(repoOwner(repo)))
+	}
+	return repoPath(repo) + "/hooks"
+}
+
+func repoPath(repo string) string {
+	parsedRepo := strings.SplitN(repo, "/", 2)
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(parsedRepo[0]), url.PathEscape(parsedRepo[1]))
+}
+
+// GetCurrentUser returns the user the token belongs to.
+func (c *APIClient) GetCurrentUser() (user *gitea.User, err error) {
+	err = c.do(http.MethodGet, "/user", nil, &user)
+	return user, err
+}
+
+func (c *APIClient) GetRepo(repo string) (res *gitea.Repository, err error) {
+	err = c.do(http.MethodGet, repoPath(repo), nil, &res)
+	return res, err
+}
+
+func (c *APIClient) GetOrg(org string) (res *gitea.Organization, err error) {
+	err = c.do(http.MethodGet, "/orgs/"+url.PathEscape(org), nil, &res)
+	return res, err
+}
+
+// ListCommits returns a page of the commits reachable from sha, newest first.
+// This endpoint needs Gitea 1.11 or later.
+func (c *APIClient) ListCommits(repo string, sha string, page int, limit int) (res []*gitea.Commit, err error) {
+	query := url.Values{}
+	query.Set("sha", sha)
+	query.Set("page", strconv.Itoa(page))
+	query.Set("limit", strconv.Itoa(limit))
+	err = c.do(http.MethodGet, repoPath(repo)+"/commits?"+query.Encode(), nil, &res)
+	return res, err
+}
+
+// CommitsBetween returns the commits reachable from head but not from base,
+// newest first. It gives up and returns false if base isn't found within max
+// commits, e.g. after a force push.
+func (c *APIClient) CommitsBetween(repo string, base string, head string, max int) (res []*gitea.Commit, ok bool, err error) {
+	const pageSize = 50
+	for page := 1; ; page++ {
+		commits, err := c.ListCommits(repo, head, page, pageSize)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, commit := range commits {
+			if commit.CommitMeta != nil && commit.SHA == base {
+				return res, true, nil
+			}
+			if len(res) == max {
+				return nil, false, nil
+			}
+			res = append(res, commit)
+		}
+		if len(commits) < pageSize {
+			return nil, false, nil
+		}
+	}
+}
+
+func (c *APIClient) CreateHook(repo string, opt gitea.CreateHookOption) (hook *gitea.Hook, err error) {
+	err = c.do(http.MethodPost, hooksPath(repo), opt, &hook)
+	return hook, err
+}
+
+func (c *APIClient) EditHook(repo string, id int64, opt gitea.EditHookOption) (hook *gitea.Hook, err error) {
+	err = c.do(http.MethodPatch, fmt.Sprintf("%s/%d", hooksPath(repo), id), opt, &hook)
+	return hook, err
+}
+
+func (c *APIClient) DeleteHook(repo string, id int64) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("%s/%d", hooksPath(repo), id), nil, nil)
+}
+
+// hookEvents translates a subscription's events to the event names Gitea
+// expects when creating a webhook. Review events are part of "pull_request",
+// and status events need pushes to know which branch a commit is on.
+func hookEvents(events []EventType) []string {
+	if len(events) == 0 {
+		events = SubscribableEventTypes
+	}
+	var res []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			res = append(res, name)
+			seen[name] = true
+		}
+	}
+	for _, event := range events {
+		switch event {
+		case EventTypePullRequestApproved, EventTypePullRequestRejected, EventTypePullRequestComment:
+			add(string(EventTypePullRequest))
+		case EventTypeStatus:
+			add(string(EventTypeStatus))
+			add(string(EventTypePush))
+		default:
+			add(string(event))
+		}
+	}
+	return res
+}
+
+// hookConfig is the configuration of the webhook for a subscription.
+func hookConfig(webhookURL string, secret string) map[string]string {
+	return map[string]string{
+		"url":          webhookURL,
+		"content_type": "json",
+		"http_method":  "post",
+		"secret":       secret,
+	}
+}
@@ -2,6 +2,9 @@ package giteabot
 
 import (
 	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 
@@ -20,15 +23,144 @@ func NewDB(db *sql.DB) *DB {
 
 // webhook subscription methods
 
-func (d *DB) CreateSubscription(convID chat1.ConvIDStr, repo string, oauthIdentifier string) error {
+// Subscription is a conversation's subscription to a repository.
+type Subscription struct {
+	ConvID chat1.ConvIDStr
+	Repo   string
+	// Events the conversation wants to hear about, or nil for all of them
+	Events []EventType
+	// Branches limits push, create, delete and status events to matching branches
+	Branches BranchFilter
+	// HookID is the Gitea webhook the bot created for this subscription, or 0
+	// if it was set up by hand
+	HookID int64
+	// Labels limits label changes to ones applying any of these labels
+	Labels LabelFilter
+	// RepoID is the Gitea ID of the repo, which survives renames and
+	// transfers, or 0 for patterns and subscriptions made before we kept it
+	RepoID int64
+	// SecretRepo is the name the webhook secret was made for, if the repo has
+	// been renamed or transferred since
+	SecretRepo string
+}
+
+const subscriptionColumns = "conv_id, repo, events, branches, hook_id, labels, repo_id, secret_repo"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSubscription(row rowScanner) (subscription Subscription, err error) {
+	var events, branches, labels string
+	if err := row.Scan(&subscription.ConvID, &subscription.Repo, &events, &branches, &subscription.HookID, &labels,
+		&subscription.RepoID, &subscription.SecretRepo); err != nil {
+		return subscription, err
+	}
+	subscription.Events = splitEventTypes(events)
+	subscription.Branches = splitBranchFilter(branches)
+	subscription.Labels = splitLabelFilter(labels)
+	return subscription, nil
+}
+
+// SecretFor returns the repo name the subscription's webhook secret is made
+// from.
+func (s Subscription) SecretFor() string {
+	if s.SecretRepo != "" {
+		return s.SecretRepo
+	}
+	return s.Repo
+}
+
+// WantsEvent reports whether eventType should be posted for this subscription.
+func (s Subscription) WantsEvent(eventType EventType) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, event := range s.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WantsBranch reports whether events on branch should be posted for this
+// subscription.
+func (s Subscription) WantsBranch(branch string) bool {
+	return s.Branches.Matches(branch)
+}
+
+// WantsAnyBranch reports whether an event on any of branches should be posted
+// for this subscription.
+func (s Subscription) WantsAnyBranch(branches []string) bool {
+	for _, branch := range branches {
+		if s.WantsBranch(branch) {
+			return true
+		}
+	}
+	return false
+}
+
+// WantsLabels reports whether a label change adding the labels in added
+// should be posted for this subscription.
+func (s Subscription) WantsLabels(added []string) bool {
+	return s.Labels.Matches(added)
+}
+
+func (d *DB) CreateSubscription(convID chat1.ConvIDStr, repo string, repoID int64, oauthIdentifier string,
+	events []EventType, branches BranchFilter, labels LabelFilter) error {
 	return d.RunTxn(func(tx *sql.Tx) error {
 		_, err := tx.Exec(`
 			INSERT INTO subscriptions
-			(conv_id, repo, oauth_identifier)
-			VALUES (?, ?, ?)
+			(conv_id, repo, repo_id, oauth_identifier, events, branches, labels)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
 			ON DUPLICATE KEY UPDATE
 			oauth_identifier=VALUES(oauth_identifier)
-		`, convID, repo, oauthIdentifier)
+		`, convID, repo, repoID, oauthIdentifier, joinEventTypes(events), branches.String(), labels.String())
+		return err
+	})
+}
+
+func (d *DB) UpdateSubscriptionEvents(convID chat1.ConvIDStr, repo string, events []EventType) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE subscriptions
+			SET events = ?
+			WHERE (conv_id = ? AND repo = ?)
+		`, joinEventTypes(events), convID, repo)
+		return err
+	})
+}
+
+func (d *DB) UpdateSubscriptionHookID(convID chat1.ConvIDStr, repo string, hookID int64) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE subscriptions
+			SET hook_id = ?
+			WHERE (conv_id = ? AND repo = ?)
+		`, hookID, convID, repo)
+		return err
+	})
+}
+
+func (d *DB) UpdateSubscriptionLabels(convID chat1.ConvIDStr, repo string, labels LabelFilter) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE subscriptions
+			SET labels = ?
+			WHERE (conv_id = ? AND repo = ?)
+		`, labels.String(), convID, repo)
+		return err
+	})
+}
+
+func (d *DB) UpdateSubscriptionBranches(convID chat1.ConvIDStr, repo string, branches BranchFilter) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE subscriptions
+			SET branches = ?
+			WHERE (conv_id = ? AND repo = ?)
+		`, branches.String(), convID, repo)
 		return err
 	})
 }
@@ -53,67 +185,92 @@ func (d *DB) DeleteSubscriptionsForRepo(convID chat1.ConvIDStr, repo string) err
 	})
 }
 
-func (d *DB) GetSubscribedConvs(repo string) (res []chat1.ConvIDStr, err error) {
+// GetSubscribedConvs returns the subscriptions covering the repository
+// fullName, both to the repository itself and to patterns like "owner/*".
+func (d *DB) GetSubscribedConvs(fullName string) (res []Subscription, err error) {
 	rows, err := d.DB.Query(`
-		SELECT conv_id
+		SELECT `+subscriptionColumns+`
 		FROM subscriptions
-		WHERE repo = ?
-		GROUP BY conv_id
-	`, repo)
+		WHERE (repo = ? OR (repo LIKE ? AND repo LIKE '%*%'))
+	`, fullName, repoOwner(fullName)+"/%")
 	if err != nil {
 		return res, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var convID chat1.ConvIDStr
-		if err := rows.Scan(&convID); err != nil {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
 			return res, err
 		}
-		res = append(res, convID)
+		if RepoMatches(subscription.Repo, fullName) {
+			res = append(res, subscription)
+		}
 	}
 	return res, nil
 }
 
-func (d *DB) GetSubscriptionExists(convID chat1.ConvIDStr, repo string) (exists bool, err error) {
+// GetMovedSubscriptions returns the subscriptions to the repo with the given ID
+// that are still under a name other than fullName, because the repo was
+// renamed or transferred since.
+func (d *DB) GetMovedSubscriptions(repoID int64, fullName string) (res []Subscription, err error) {
+	rows, err := d.DB.Query(`
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions
+		WHERE (repo_id = ? AND repo != ?)
+	`, repoID, fullName)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, subscription)
+	}
+	return res, nil
+}
+
+func (d *DB) GetSubscription(convID chat1.ConvIDStr, repo string) (*Subscription, error) {
 	row := d.DB.QueryRow(`
-	SELECT 1
+	SELECT `+subscriptionColumns+`
 	FROM subscriptions
 	WHERE (conv_id = ? AND repo = ?)
-	GROUP BY conv_id
 	`, convID, repo)
-	var rowRes string
-	scanErr := row.Scan(&rowRes)
-	switch scanErr {
+	subscription, err := scanSubscription(row)
+	switch err {
 	case sql.ErrNoRows:
-		return false, nil
+		return nil, nil
 	case nil:
-		return true, nil
+		return &subscription, nil
 	default:
-		return false, scanErr
+		return nil, err
 	}
 }
 
-func (d *DB) GetSubscriptionForRepoExists(convID chat1.ConvIDStr, repo string) (exists bool, err error) {
+func (d *DB) GetSubscriptionExists(convID chat1.ConvIDStr, repo string) (exists bool, err error) {
 	row := d.DB.QueryRow(`
 	SELECT 1
 	FROM subscriptions
 	WHERE (conv_id = ? AND repo = ?)
+	GROUP BY conv_id
 	`, convID, repo)
 	var rowRes string
-	err = row.Scan(&rowRes)
-	switch err {
+	scanErr := row.Scan(&rowRes)
+	switch scanErr {
 	case sql.ErrNoRows:
 		return false, nil
 	case nil:
 		return true, nil
 	default:
-		return false, err
+		return false, scanErr
 	}
 }
 
-func (d *DB) GetAllSubscriptionsForConvID(convID chat1.ConvIDStr) (res []string, err error) {
+func (d *DB) GetAllSubscriptionsForConvID(convID chat1.ConvIDStr) (res []Subscription, err error) {
 	rows, err := d.DB.Query(`
-		SELECT repo
+		SELECT `+subscriptionColumns+`
 		FROM subscriptions
 		WHERE conv_id = ?
 		ORDER BY repo
@@ -123,11 +280,785 @@ func (d *DB) GetAllSubscriptionsForConvID(convID chat1.ConvIDStr) (res []string,
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var repo string
-		if err := rows.Scan(&repo); err != nil {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
 			return res, err
 		}
-		res = append(res, repo)
+		res = append(res, subscription)
 	}
 	return res, nil
-}
\ No newline at end of file
+}
+
+// Gitea API token methods
+
+func (d *DB) SetUserToken(username string, token string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO user_tokens
+			(username, token)
+			VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE
+			token=VALUES(token)
+		`, username, token)
+		return err
+	})
+}
+
+func (d *DB) DeleteUserToken(username string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			DELETE FROM user_tokens
+			WHERE username = ?
+		`, username)
+		return err
+	})
+}
+
+func (d *DB) GetUserToken(username string) (token string, err error) {
+	row := d.DB.QueryRow(`
+	SELECT token
+	FROM user_tokens
+	WHERE username = ?
+	`, username)
+	err = row.Scan(&token)
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return token, nil
+	default:
+		return "", err
+	}
+}
+
+// repository state methods
+
+// RepoState is what we last saw of whether a repository is archived or private.
+type RepoState struct {
+	Archived bool
+	Private  bool
+}
+
+// GetRepoState returns what we last saw of the repo with the given ID, or nil
+// if we haven't seen it yet.
+func (d *DB) GetRepoState(repoID int64) (*RepoState, error) {
+	var state RepoState
+	row := d.DB.QueryRow(`
+	SELECT archived, private
+	FROM repo_state
+	WHERE repo_id = ?
+	`, repoID)
+	err := row.Scan(&state.Archived, &state.Private)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &state, nil
+	default:
+		return nil, err
+	}
+}
+
+func setRepoState(repoID int64, state RepoState) StateUpdate {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO repo_state
+			(repo_id, archived, private)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			archived=VALUES(archived),
+			private=VALUES(private)
+		`, repoID, state.Archived, state.Private)
+		return err
+	}
+}
+
+// setSubscriptionRepoID records the ID of repo on the subscriptions to it that
+// were made before we kept track of it.
+func setSubscriptionRepoID(repo string, repoID int64) StateUpdate {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE subscriptions
+			SET repo_id = ?
+			WHERE (repo = ? AND repo_id = 0)
+		`, repoID, repo)
+		return err
+	}
+}
+
+// renameRepo points the subscriptions to the repo with the given ID, and what
+// we remember about its issues, branches and statuses, from oldRepo to newRepo
+// after it was renamed or transferred. The subscriptions keep the webhook
+// secret made for their original name, since Gitea keeps the webhook as is.
+// Conversations that were already subscribed to newRepo keep that subscription
+// instead.
+func renameRepo(repoID int64, oldRepo string, newRepo string) StateUpdate {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE IGNORE subscriptions
+			SET secret_repo = IF(secret_repo = '', repo, secret_repo),
+			repo = ?
+			WHERE (repo = ? AND repo_id = ?)
+		`, newRepo, oldRepo, repoID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			DELETE FROM subscriptions
+			WHERE (repo = ? AND repo_id = ?)
+		`, oldRepo, repoID); err != nil {
+			return err
+		}
+		for _, table := range []string{"issue_state", "branch_heads", "commit_status_state", "chat_messages", "delivery_queue"} {
+			if _, err := tx.Exec(`UPDATE IGNORE `+table+` SET repo = ? WHERE repo = ?`, newRepo, oldRepo); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// issue and pull request state methods
+
+// StateUpdate records something we learned from a webhook, like a branch's new
+// head. Updates are applied in the transaction that queues the event's
+// deliveries, so they're only kept if the event is.
+type StateUpdate func(tx *sql.Tx) error
+
+// ApplyStateUpdates applies updates for an event that has nothing to queue.
+func (d *DB) ApplyStateUpdates(updates []StateUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return d.RunTxn(func(tx *sql.Tx) error {
+		for _, update := range updates {
+			if err := update(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPullRequestHead returns the head commit we last saw for a pull request,
+// or "" if we haven't seen it before.
+func (d *DB) GetPullRequestHead(repo string, index int64) (sha string, err error) {
+	row := d.DB.QueryRow(`
+	SELECT head_sha
+	FROM issue_state
+	WHERE (repo = ? AND item_index = ?)
+	`, repo, index)
+	err = row.Scan(&sha)
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return sha, nil
+	default:
+		return "", err
+	}
+}
+
+func setPullRequestHead(repo string, index int64, sha string) StateUpdate {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO issue_state
+			(repo, item_index, head_sha)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			head_sha=VALUES(head_sha)
+		`, repo, index, sha)
+		return err
+	}
+}
+
+// IssueState is what we last saw of an issue or pull request's labels,
+// milestone and assignees (by username).
+type IssueState struct {
+	Labels    []string
+	Milestone string
+	Assignees []string
+}
+
+// GetIssueState returns the last state we saw for an issue or pull request, or
+// nil if we haven't seen it before.
+func (d *DB) GetIssueState(repo string, index int64) (*IssueState, error) {
+	row := d.DB.QueryRow(`
+	SELECT labels, milestone, assignees
+	FROM issue_state
+	WHERE (repo = ? AND item_index = ?)
+	`, repo, index)
+	var labels, assignees string
+	var state IssueState
+	switch err := row.Scan(&labels, &state.Milestone, &assignees); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+	default:
+		return nil, err
+	}
+	if labels == "" {
+		// only the head commit was recorded so far
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(labels), &state.Labels); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(assignees), &state.Assignees); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func setIssueState(repo string, index int64, state IssueState) StateUpdate {
+	// store empty lists as [] so we can tell them apart from unknown state
+	if state.Labels == nil {
+		state.Labels = []string{}
+	}
+	if state.Assignees == nil {
+		state.Assignees = []string{}
+	}
+	return func(tx *sql.Tx) error {
+		labels, err := json.Marshal(state.Labels)
+		if err != nil {
+			return err
+		}
+		assignees, err := json.Marshal(state.Assignees)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO issue_state
+			(repo, item_index, labels, milestone, assignees)
+			VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			labels=VALUES(labels),
+			milestone=VALUES(milestone),
+			assignees=VALUES(assignees)
+		`, repo, index, string(labels), state.Milestone, string(assignees))
+		return err
+	}
+}
+
+// branch and commit status methods
+
+func setBranchHead(repo string, branch string, sha string) StateUpdate {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO branch_heads
+			(repo, branch, head_sha)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			head_sha=VALUES(head_sha)
+		`, repo, branch, sha)
+		return err
+	}
+}
+
+// GetBranchesAtCommit returns the branches of repo whose last pushed head
+// commit is sha.
+func (d *DB) GetBranchesAtCommit(repo string, sha string) (res []string, err error) {
+	rows, err := d.DB.Query(`
+	SELECT branch
+	FROM branch_heads
+	WHERE (repo = ? AND head_sha = ?)
+	ORDER BY branch
+	`, repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var branch string
+		if err := rows.Scan(&branch); err != nil {
+			return nil, err
+		}
+		res = append(res, branch)
+	}
+	return res, rows.Err()
+}
+
+// GetCommitStatusOutcome returns the last outcome we saw for a status context
+// on a branch, or "" if we haven't seen one.
+func (d *DB) GetCommitStatusOutcome(repo string, branch string, context string) (outcome StatusOutcome, err error) {
+	row := d.DB.QueryRow(`
+	SELECT outcome
+	FROM commit_status_state
+	WHERE (repo = ? AND branch = ? AND context = ?)
+	`, repo, branch, context)
+	err = row.Scan(&outcome)
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return outcome, nil
+	default:
+		return "", err
+	}
+}
+
+func setCommitStatusOutcome(repo string, branches []string, context string, outcome StatusOutcome) StateUpdate {
+	return func(tx *sql.Tx) error {
+		for _, branch := range branches {
+			_, err := tx.Exec(`
+				INSERT INTO commit_status_state
+				(repo, branch, context, outcome)
+				VALUES (?, ?, ?, ?)
+				ON DUPLICATE KEY UPDATE
+				outcome=VALUES(outcome)
+			`, repo, branch, context, outcome)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// delivery queue methods
+
+// Thread identifies the issue or pull request a message is about. Messages
+// about the same item are posted as replies to the first one.
+type Thread struct {
+	Repo  string
+	Index int64
+	// Card is the item's status card, for events that change it. It's posted
+	// in place of the message, or edited into the first message if that was a
+	// card too.
+	Card string
+}
+
+// Delivery is a chat message waiting in the delivery queue.
+type Delivery struct {
+	ID       int64
+	ConvID   chat1.ConvIDStr
+	Message  string
+	Thread   Thread
+	Attempts int
+	// Sync is set for pull request updates whose new commits are looked up
+	// when the message is sent
+	Sync *PullRequestSync
+}
+
+// EnqueueDeliveries queues each of deliveries, which are rendered for their
+// conversation, and records that the conversation got the X-Gitea-Delivery IDs
+// the message was made from. When dedupWindow is positive, conversations that
+// already got all of them within the window are skipped. updates are applied in
+// the same transaction. It returns the conversations a message was queued for.
+func (d *DB) EnqueueDeliveries(deliveries []Delivery, deliveryIDs []string,
+	dedupWindow time.Duration, updates []StateUpdate) (queued []chat1.ConvIDStr, err error) {
+	convIDs := make([]chat1.ConvIDStr, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		convIDs = append(convIDs, delivery.ConvID)
+	}
+	err = d.RunTxn(func(tx *sql.Tx) error {
+		queued = nil
+		fresh, err := filterWebhookDeliveries(tx, convIDs, deliveryIDs, dedupWindow)
+		if err != nil {
+			return err
+		}
+		isFresh := make(map[chat1.ConvIDStr]bool)
+		for _, convID := range fresh {
+			isFresh[convID] = true
+		}
+		for _, delivery := range deliveries {
+			if !isFresh[delivery.ConvID] {
+				continue
+			}
+			var sync []byte
+			if delivery.Sync != nil {
+				var err error
+				if sync, err = json.Marshal(delivery.Sync); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`
+				INSERT INTO delivery_queue
+				(conv_id, message, repo, item_index, card, pr_sync)
+				VALUES (?, ?, ?, ?, ?, ?)
+			`, delivery.ConvID, delivery.Message, delivery.Thread.Repo, delivery.Thread.Index, delivery.Thread.Card, string(sync))
+			if err != nil {
+				return err
+			}
+			queued = append(queued, delivery.ConvID)
+		}
+		for _, update := range updates {
+			if err := update(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return queued, err
+}
+
+// ClaimDeliveries returns up to limit deliveries that are due, and pushes their
+// next attempt back by lease so no other worker picks them up in the meantime.
+// Only a conversation's oldest delivery is claimed, so its messages are sent one
+// at a time and in order, and one that's waiting to be retried holds back the
+// rest until it's sent or dead-lettered.
+// If the bot dies before finishing a delivery, it is retried once the lease
+// runs out.
+func (d *DB) ClaimDeliveries(limit int, lease time.Duration) (res []Delivery, err error) {
+	err = d.RunTxn(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`
+			SELECT id, conv_id, message, repo, item_index, card, pr_sync, attempts
+			FROM delivery_queue d
+			WHERE (dead = false AND next_attempt_at <= NOW() AND NOT EXISTS (
+				SELECT 1
+				FROM delivery_queue earlier
+				WHERE (earlier.conv_id = d.conv_id AND earlier.dead = false AND earlier.id < d.id)
+			))
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE
+		`, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var delivery Delivery
+			var sync string
+			if err := rows.Scan(&delivery.ID, &delivery.ConvID, &delivery.Message, &delivery.Thread.Repo,
+				&delivery.Thread.Index, &delivery.Thread.Card, &sync, &delivery.Attempts); err != nil {
+				return err
+			}
+			if sync != "" {
+				delivery.Sync = &PullRequestSync{}
+				if err := json.Unmarshal([]byte(sync), delivery.Sync); err != nil {
+					return err
+				}
+			}
+			res = append(res, delivery)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return nil
+		}
+
+		args := []interface{}{int(lease.Seconds())}
+		placeholders := make([]string, 0, len(res))
+		for _, delivery := range res {
+			args = append(args, delivery.ID)
+			placeholders = append(placeholders, "?")
+		}
+		_, err = tx.Exec(`
+			UPDATE delivery_queue
+			SET next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+			WHERE id IN (`+strings.Join(placeholders, ",")+`)
+		`, args...)
+		return err
+	})
+	return res, err
+}
+
+// HasNewerCard returns whether a status card for the same thread as delivery
+// is queued behind it.
+func (d *DB) HasNewerCard(delivery Delivery) (newer bool, err error) {
+	row := d.DB.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1
+		FROM delivery_queue
+		WHERE (conv_id = ? AND repo = ? AND item_index = ? AND card != '' AND dead = false AND id > ?)
+	)
+	`, delivery.ConvID, delivery.Thread.Repo, delivery.Thread.Index, delivery.ID)
+	err = row.Scan(&newer)
+	return newer, err
+}
+
+func (d *DB) CompleteDelivery(id int64) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			DELETE FROM delivery_queue
+			WHERE id = ?
+		`, id)
+		return err
+	})
+}
+
+func (d *DB) RetryDelivery(id int64, attempts int, backoff time.Duration, lastError string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE delivery_queue
+			SET attempts = ?, last_error = ?, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+			WHERE id = ?
+		`, attempts, truncateError(lastError), int(backoff.Seconds()), id)
+		return err
+	})
+}
+
+func (d *DB) DeadLetterDelivery(id int64, attempts int, lastError string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE delivery_queue
+			SET attempts = ?, last_error = ?, dead = true
+			WHERE id = ?
+		`, attempts, truncateError(lastError), id)
+		return err
+	})
+}
+
+// conversation template methods
+
+// GetConvTemplate returns the template convID set for name, or "" if it uses
+// the default.
+func (d *DB) GetConvTemplate(convID chat1.ConvIDStr, name string) (text string, err error) {
+	row := d.DB.QueryRow(`
+	SELECT template
+	FROM conv_templates
+	WHERE (conv_id = ? AND name = ?)
+	`, convID, name)
+	err = row.Scan(&text)
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return text, nil
+	default:
+		return "", err
+	}
+}
+
+// GetConvTemplateNames returns the names of the templates convID has set.
+func (d *DB) GetConvTemplateNames(convID chat1.ConvIDStr) (res []string, err error) {
+	rows, err := d.DB.Query(`
+	SELECT name
+	FROM conv_templates
+	WHERE conv_id = ?
+	ORDER BY name
+	`, convID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+func (d *DB) SetConvTemplate(convID chat1.ConvIDStr, name string, text string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO conv_templates
+			(conv_id, name, template)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			template=VALUES(template)
+		`, convID, name, text)
+		return err
+	})
+}
+
+func (d *DB) DeleteConvTemplate(convID chat1.ConvIDStr, name string) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			DELETE FROM conv_templates
+			WHERE (conv_id = ? AND name = ?)
+		`, convID, name)
+		return err
+	})
+}
+
+// conversation setting methods
+
+// GetConvStyle returns the message style of convID.
+func (d *DB) GetConvStyle(convID chat1.ConvIDStr) (style Style, err error) {
+	row := d.DB.QueryRow(`
+	SELECT style
+	FROM conv_settings
+	WHERE conv_id = ?
+	`, convID)
+	err = row.Scan(&style)
+	switch err {
+	case sql.ErrNoRows:
+		return StyleNormal, nil
+	case nil:
+		return style, nil
+	default:
+		return "", err
+	}
+}
+
+func (d *DB) SetConvStyle(convID chat1.ConvIDStr, style Style) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO conv_settings
+			(conv_id, style)
+			VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE
+			style=VALUES(style)
+		`, convID, style)
+		return err
+	})
+}
+
+// chat message methods
+
+// GetThreadMessage returns the message we posted first about thread in convID,
+// or 0 if there isn't one, and whether that message is a status card.
+func (d *DB) GetThreadMessage(convID chat1.ConvIDStr, thread Thread) (msgID chat1.MessageID, card bool, err error) {
+	row := d.DB.QueryRow(`
+	SELECT msg_id, card
+	FROM chat_messages
+	WHERE (conv_id = ? AND repo = ? AND item_index = ?)
+	`, convID, thread.Repo, thread.Index)
+	err = row.Scan(&msgID, &card)
+	switch err {
+	case sql.ErrNoRows:
+		return 0, false, nil
+	case nil:
+		return msgID, card, nil
+	default:
+		return 0, false, err
+	}
+}
+
+func (d *DB) SetThreadMessage(convID chat1.ConvIDStr, thread Thread, msgID chat1.MessageID, card bool) error {
+	return d.RunTxn(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO chat_messages
+			(conv_id, repo, item_index, msg_id, card)
+			VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			msg_id=VALUES(msg_id),
+			card=VALUES(card)
+		`, convID, thread.Repo, thread.Index, msgID, card)
+		return err
+	})
+}
+
+// webhook delivery methods
+
+// UnseenWebhookDeliveries returns the ones of convIDs that haven't got the
+// webhook delivery with the given ID within dedupWindow, without recording
+// anything. All of convIDs are returned if deduplication is disabled.
+func (d *DB) UnseenWebhookDeliveries(convIDs []chat1.ConvIDStr, deliveryID string,
+	dedupWindow time.Duration) (unseen []chat1.ConvIDStr, err error) {
+	if deliveryID == "" || dedupWindow <= 0 {
+		return convIDs, nil
+	}
+	rows, err := d.DB.Query(`
+	SELECT conv_id
+	FROM webhook_deliveries
+	WHERE (delivery_id = ? AND received_at >= DATE_SUB(NOW(), INTERVAL ? SECOND))
+	`, deliveryID, int(dedupWindow.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[chat1.ConvIDStr]bool)
+	for rows.Next() {
+		var convID chat1.ConvIDStr
+		if err := rows.Scan(&convID); err != nil {
+			return nil, err
+		}
+		seen[convID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, convID := range convIDs {
+		if !seen[convID] {
+			unseen = append(unseen, convID)
+		}
+	}
+	return unseen, nil
+}
+
+// filterWebhookDeliveries records that each of convIDs got the webhook
+// deliveries with the given IDs, and returns the ones that hadn't already seen
+// all of them within dedupWindow. All of convIDs are returned if deduplication
+// is disabled.
+func filterWebhookDeliveries(tx *sql.Tx, convIDs []chat1.ConvIDStr, deliveryIDs []string,
+	dedupWindow time.Duration) (fresh []chat1.ConvIDStr, err error) {
+	if dedupWindow <= 0 {
+		return convIDs, nil
+	}
+	for _, convID := range convIDs {
+		var recorded, duplicates int
+		for _, deliveryID := range deliveryIDs {
+			if deliveryID == "" {
+				continue
+			}
+			duplicate, err := recordWebhookDelivery(tx, convID, deliveryID, dedupWindow)
+			if err != nil {
+				return nil, err
+			}
+			recorded++
+			if duplicate {
+				duplicates++
+			}
+		}
+		if recorded == 0 || duplicates < recorded {
+			fresh = append(fresh, convID)
+		}
+	}
+	return fresh, nil
+}
+
+// recordWebhookDelivery remembers that convID got the webhook delivery with the
+// given ID, and reports whether it had already seen it within window. Records
+// older than window are dropped along the way.
+func recordWebhookDelivery(tx *sql.Tx, convID chat1.ConvIDStr, deliveryID string, window time.Duration) (duplicate bool, err error) {
+	_, err = tx.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE (conv_id = ? AND received_at < DATE_SUB(NOW(), INTERVAL ? SECOND))
+	`, convID, int(window.Seconds()))
+	if err != nil {
+		return false, err
+	}
+
+	row := tx.QueryRow(`
+		SELECT 1
+		FROM webhook_deliveries
+		WHERE (conv_id = ? AND delivery_id = ?)
+		FOR UPDATE
+	`, convID, deliveryID)
+	var rowRes string
+	switch err := row.Scan(&rowRes); err {
+	case sql.ErrNoRows:
+	case nil:
+		return true, nil
+	default:
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO webhook_deliveries
+		(conv_id, delivery_id)
+		VALUES (?, ?)
+	`, convID, deliveryID)
+	return false, err
+}
+
+// ForgetWebhookDelivery allows the given delivery to be posted to convID again.
+func (d *DB) ForgetWebhookDelivery(convID chat1.ConvIDStr, deliveryID string) (found bool, err error) {
+	err = d.RunTxn(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+			DELETE FROM webhook_deliveries
+			WHERE (conv_id = ? AND delivery_id = ?)
+		`, convID, deliveryID)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		found = affected > 0
+		return err
+	})
+	return found, err
+}
+
+// truncateError keeps an error message within the last_error column.
+func truncateError(msg string) string {
+	if runes := []rune(msg); len(runes) > 255 {
+		return string(runes[:255])
+	}
+	return msg
+}
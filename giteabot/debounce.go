@@ -0,0 +1,190 @@
+package giteabot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/managed-bots/base"
+)
+
+type pushKey struct {
+	convID chat1.ConvIDStr
+	repo   string
+	branch string
+}
+
+// pendingPush collects the pushes to a branch within one debounce window, and
+// the X-Gitea-Delivery IDs they came with.
+type pendingPush struct {
+	pushes      []PushData
+	pushers     []string
+	deliveryIDs []string
+	timer       *time.Timer
+}
+
+func (p *pendingPush) add(push PushData, deliveryID string) {
+	if deliveryID != "" {
+		for _, id := range p.deliveryIDs {
+			if id == deliveryID {
+				// redelivered while waiting
+				return
+			}
+		}
+		p.deliveryIDs = append(p.deliveryIDs, deliveryID)
+	}
+	p.pushes = append(p.pushes, push)
+	for _, pusher := range p.pushers {
+		if pusher == push.Pusher {
+			return
+		}
+	}
+	p.pushers = append(p.pushers, push.Pusher)
+}
+
+// data merges the pending pushes. Pushes that carry on from the one before have
+// their commits added to the list. A push that doesn't, like a force push after
+// a rebase, rewrote the branch, so the list starts over with its commits.
+func (p *pendingPush) data() PushData {
+	last := p.pushes[len(p.pushes)-1]
+	if len(p.pushes) == 1 {
+		return last
+	}
+
+	res := PushData{
+		Pusher:     strings.Join(p.pushers, ", "),
+		Repo:       last.Repo,
+		Branch:     last.Branch,
+		NumPushes:  len(p.pushes),
+		CommitURL:  last.CommitURL,
+		CompareURL: joinCompareURLs(p.pushes[0].CompareURL, last.CompareURL),
+		Before:     p.pushes[0].Before,
+	}
+	for _, push := range p.pushes {
+		if push.Before != "" && res.After != "" && push.Before != res.After {
+			res.Commits = nil
+			res.NumCommits = 0
+		}
+		res.Commits = append(res.Commits, push.Commits...)
+		res.NumCommits += push.NumCommits
+		res.After = push.After
+	}
+	return res
+}
+
+// joinCompareURLs turns the compare URLs of the first and last of several
+// pushes, like ".../compare/a...b" and ".../compare/c...d", into one covering
+// all of them, ".../compare/a...d". It returns "" if either is missing.
+func joinCompareURLs(first string, last string) string {
+	i := strings.LastIndex(first, "...")
+	j := strings.LastIndex(last, "...")
+	if i < 0 || j < 0 {
+		return ""
+	}
+	return first[:i] + last[j:]
+}
+
+// PushDebouncer coalesces the pushes a conversation gets for the same branch
+// within a window into a single message. The window starts with the first push
+// and isn't extended by later ones, so a steady stream of pushes is still
+// posted regularly. Anything pending is posted on shutdown.
+//
+// Pending pushes are only kept in memory. Their deliveries are recorded for
+// deduplication once the batch is queued, so if the bot dies before then, Gitea
+// redeliveries of them are still accepted.
+type PushDebouncer struct {
+	*base.DebugOutput
+
+	db        *DB
+	queue     *DeliveryQueue
+	templates *Templates
+	window    time.Duration
+	// dedupWindow is how long queued deliveries are remembered for
+	dedupWindow time.Duration
+
+	mu       sync.Mutex
+	pending  map[pushKey]*pendingPush
+	shutdown bool
+}
+
+func NewPushDebouncer(debugConfig *base.ChatDebugOutputConfig, db *DB, queue *DeliveryQueue, templates *Templates,
+	window time.Duration, dedupWindow time.Duration) *PushDebouncer {
+	return &PushDebouncer{
+		DebugOutput: base.NewDebugOutput("PushDebouncer", debugConfig),
+		db:          db,
+		queue:       queue,
+		templates:   templates,
+		window:      window,
+		dedupWindow: dedupWindow,
+		pending:     make(map[pushKey]*pendingPush),
+	}
+}
+
+// Enabled reports whether pushes should go through the debouncer at all.
+func (d *PushDebouncer) Enabled() bool {
+	return d != nil && d.window > 0
+}
+
+// Add holds push, which came with the given X-Gitea-Delivery ID, back for each
+// of convIDs until the debounce window for its branch runs out.
+func (d *PushDebouncer) Add(convIDs []chat1.ConvIDStr, push PushData, deliveryID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, convID := range convIDs {
+		key := pushKey{convID: convID, repo: push.Repo, branch: push.Branch}
+		pending, ok := d.pending[key]
+		if !ok {
+			pending = &pendingPush{}
+			if d.shutdown {
+				// too late to wait for more
+				pending.add(push, deliveryID)
+				d.enqueue(key, pending)
+				continue
+			}
+			d.pending[key] = pending
+			pending.timer = time.AfterFunc(d.window, func() { d.flush(key) })
+		}
+		pending.add(push, deliveryID)
+	}
+}
+
+func (d *PushDebouncer) flush(key pushKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending, ok := d.pending[key]
+	if !ok {
+		return
+	}
+	delete(d.pending, key)
+	d.enqueue(key, pending)
+}
+
+func (d *PushDebouncer) enqueue(key pushKey, pending *pendingPush) {
+	text, err := d.templates.Render(key.convID, &Message{Template: TemplatePush, Data: pending.data()})
+	if err != nil {
+		d.Debug("unable to render pushes for %s: %s", key.convID, err)
+	}
+	if text == "" {
+		return
+	}
+	delivery := Delivery{ConvID: key.convID, Message: text}
+	if _, err := d.db.EnqueueDeliveries([]Delivery{delivery}, pending.deliveryIDs, d.dedupWindow, nil); err != nil {
+		d.Errorf("unable to queue pushes to %s %s for %s: %s", key.repo, key.branch, key.convID, err)
+		return
+	}
+	d.queue.Poke()
+}
+
+// Shutdown posts all pending pushes right away.
+func (d *PushDebouncer) Shutdown() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.shutdown = true
+	for key, pending := range d.pending {
+		pending.timer.Stop()
+		delete(d.pending, key)
+		d.enqueue(key, pending)
+	}
+	return nil
+}
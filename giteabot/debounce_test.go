@@ -0,0 +1,46 @@
+package giteabot
+
+import "testing"
+
+func TestPendingPushData(t *testing.T) {
+	push := func(before string, after string, messages ...string) PushData {
+		data := PushData{Pusher: "vlad", Repo: "vlad/Managed-Qubes", Branch: "master", NumPushes: 1,
+			NumCommits: len(messages), Before: before, After: after}
+		for _, message := range messages {
+			data.Commits = append(data.Commits, CommitData{Message: message})
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		pushes []PushData
+		want   []string
+	}{
+		{"one push", []PushData{push("a", "b", "wip")}, []string{"wip"}},
+		{"same messages", []PushData{push("a", "b", "fix typo"), push("b", "c", "fix typo")}, []string{"fix typo", "fix typo"}},
+		{"force push", []PushData{push("a", "b", "wip", "wip"), push("a", "d", "Add sys-usb")}, []string{"Add sys-usb"}},
+		{"force push in between", []PushData{push("a", "b", "one"), push("x", "c", "two"), push("c", "d", "three")},
+			[]string{"two", "three"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pending := &pendingPush{}
+			for _, push := range test.pushes {
+				pending.add(push, "")
+			}
+			data := pending.data()
+			var got []string
+			for _, commit := range data.Commits {
+				got = append(got, commit.Message)
+			}
+			if len(got) != len(test.want) || data.NumCommits != len(test.want) {
+				t.Fatalf("data() has %d commits %q, want %q", data.NumCommits, got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("data() commits = %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package giteabot
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"strings"
 
+	gitea "code.gitea.io/gitea/modules/structs"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -16,23 +19,27 @@ type Handler struct {
 	stats      *base.StatsRegistry
 	kbc        *kbchat.API
 	db         *DB
+	templates  *Templates
 	httpPrefix string
 	secret     string
 	giteaURL   string
+	giteaToken string
 }
 
 var _ base.Handler = (*Handler)(nil)
 
 func NewHandler(stats *base.StatsRegistry, kbc *kbchat.API, debugConfig *base.ChatDebugOutputConfig,
-	db *DB, httpPrefix string, secret string, giteaURL string) *Handler {
+	db *DB, templates *Templates, httpPrefix string, secret string, giteaURL string, giteaToken string) *Handler {
 	return &Handler{
 		DebugOutput: base.NewDebugOutput("Handler", debugConfig),
 		stats:       stats.SetPrefix("Handler"),
 		kbc:         kbc,
 		db:          db,
+		templates:   templates,
 		httpPrefix:  httpPrefix,
 		secret:      secret,
-		giteaURL:	 giteaURL,
+		giteaURL:    giteaURL,
+		giteaToken:  giteaToken,
 	}
 }
 
@@ -47,7 +54,8 @@ func (h *Handler) HandleCommand(msg chat1.MsgSummary) error {
 		return nil
 	}
 
-	cmd := strings.ToLower(strings.TrimSpace(msg.Content.Text.Body))
+	body := strings.TrimSpace(msg.Content.Text.Body)
+	cmd := strings.ToLower(body)
 	if !strings.HasPrefix(cmd, "!gitea") {
 		return nil
 	}
@@ -58,12 +66,27 @@ func (h *Handler) HandleCommand(msg chat1.MsgSummary) error {
 		return h.handleListSubscriptions(msg)
 	case strings.HasPrefix(cmd, "!gitea subscribe"):
 		h.stats.Count("subscribe")
-		return h.handleSubscribe(cmd, msg, true)
+		// branch globs are case sensitive, so keep the original text around
+		return h.handleSubscribe(body, msg, true)
 	case strings.HasPrefix(cmd, "!gitea unsubscribe"):
 		h.stats.Count("unsubscribe")
 		return h.handleSubscribe(cmd, msg, false)
+	case strings.HasPrefix(cmd, "!gitea token"):
+		h.stats.Count("token")
+		// tokens are case sensitive
+		return h.handleToken(body, msg)
+	case strings.HasPrefix(cmd, "!gitea replay"):
+		h.stats.Count("replay")
+		return h.handleReplay(cmd, msg)
+	case strings.HasPrefix(cmd, "!gitea style"):
+		h.stats.Count("style")
+		return h.handleStyle(cmd, msg)
+	case strings.HasPrefix(cmd, "!gitea template"):
+		h.stats.Count("template")
+		// templates are case sensitive
+		return h.handleTemplate(body, msg)
 	default:
-		h.ChatEcho(msg.ConvID, "Unknown command.", cmd)
+		h.ChatEcho(msg.ConvID, "Unknown command.")
 	}
 	return nil
 }
@@ -80,8 +103,8 @@ func (h *Handler) handleListSubscriptions(msg chat1.MsgSummary) (err error) {
 	}
 
 	var res string
-	for _, repo := range subscriptions {
-		res += fmt.Sprintf("- *%s*\n", repo)
+	for _, subscription := range subscriptions {
+		res += fmt.Sprintf("- *%s* (%s)\n", subscription.Repo, formatSubscriptionFilters(subscription))
 	}
 	h.ChatEcho(msg.ConvID, res)
 	return nil
@@ -102,23 +125,58 @@ func (h *Handler) handleSubscribe(cmd string, msg chat1.MsgSummary, create bool)
 		return nil
 	}
 
-	repo := args[0]
-	alreadyExists, err := h.db.GetSubscriptionForRepoExists(msg.ConvID, repo)
+	repo := strings.ToLower(args[0])
+	subscription, err := h.db.GetSubscription(msg.ConvID, repo)
 	if err != nil {
 		return fmt.Errorf("error checking subscription: %s", err)
 	}
+	alreadyExists := subscription != nil
 
-	parsedRepo := strings.Split(repo, "/")
-	if len(parsedRepo) <= 1 {
-		h.ChatEcho(msg.ConvID, "invalid repo: %q, expected `<owner/repo>`", repo)
+	if err := ValidateRepo(repo); err != nil {
+		h.ChatEcho(msg.ConvID, "invalid repo: %q, expected `<owner/repo>` or `<owner/*>`: %s", repo, err)
 		return nil
 	}
 	if create {
+		opts, userErr := parseSubscribeOptions(args[1:])
+		if userErr != "" {
+			h.ChatEcho(msg.ConvID, userErr)
+			return nil
+		}
+
 		if !alreadyExists {
-			err = h.db.CreateSubscription(msg.ConvID, repo, base.IdentifierFromMsg(msg))
+			fullName, repoID, userErr, err := h.lookupRepo(msg.Sender.Username, repo)
+			if err != nil {
+				return err
+			} else if userErr != "" {
+				h.ChatEcho(msg.ConvID, userErr)
+				return nil
+			}
+			repo = fullName
+
+			err = h.db.CreateSubscription(msg.ConvID, repo, repoID, base.IdentifierFromMsg(msg), opts.events, opts.branches, opts.labels)
 			if err != nil {
 				return fmt.Errorf("error creating subscription: %s", err)
 			}
+
+			res, ok, err := h.provisionHook(msg.Sender.Username, Subscription{
+				ConvID:   msg.ConvID,
+				Repo:     repo,
+				Events:   opts.events,
+				Branches: opts.branches,
+				Labels:   opts.labels,
+				RepoID:   repoID,
+			})
+			if err != nil {
+				return err
+			}
+			if ok {
+				h.ChatEcho(msg.ConvID, "OK! You're subscribed to `%s` here. %s", repo, res)
+				return nil
+			}
+			if res != "" {
+				h.ChatEcho(msg.ConvID, res)
+			}
+
 			_, err = h.kbc.SendMessageByTlfName(msg.Sender.Username, formatSetupInstructions(h.giteaURL, repo, msg, h.httpPrefix, h.secret))
 			if err != nil {
 				return fmt.Errorf("error sending message: %s", err)
@@ -129,6 +187,41 @@ func (h *Handler) handleSubscribe(cmd string, msg chat1.MsgSummary, create bool)
 			return nil
 		}
 
+		if opts.eventsSet || opts.branchesSet || opts.labelsSet {
+			if opts.eventsSet {
+				if err = h.db.UpdateSubscriptionEvents(msg.ConvID, repo, opts.events); err != nil {
+					return fmt.Errorf("error updating subscription: %s", err)
+				}
+			}
+			if opts.branchesSet {
+				if err = h.db.UpdateSubscriptionBranches(msg.ConvID, repo, opts.branches); err != nil {
+					return fmt.Errorf("error updating subscription: %s", err)
+				}
+			}
+			if opts.labelsSet {
+				if err = h.db.UpdateSubscriptionLabels(msg.ConvID, repo, opts.labels); err != nil {
+					return fmt.Errorf("error updating subscription: %s", err)
+				}
+			}
+			res := fmt.Sprintf("OK! I've updated what I post for `%s` here.", repo)
+			if subscription.HookID != 0 {
+				subscription, err = h.db.GetSubscription(msg.ConvID, repo)
+				if err != nil {
+					return fmt.Errorf("error checking subscription: %s", err)
+				}
+				// the webhook only needs to send the events we post
+				hookRes, _, err := h.provisionHook(msg.Sender.Username, *subscription)
+				if err != nil {
+					return err
+				}
+				if hookRes != "" {
+					res += " " + hookRes
+				}
+			}
+			h.ChatEcho(msg.ConvID, res)
+			return nil
+		}
+
 		h.ChatEcho(msg.ConvID, "You're already receiving notifications for `%s` here!", repo)
 		return nil
 	}
@@ -138,10 +231,455 @@ func (h *Handler) handleSubscribe(cmd string, msg chat1.MsgSummary, create bool)
 		if err != nil {
 			return fmt.Errorf("error deleting subscriptions: %s", err)
 		}
-		h.ChatEcho(msg.ConvID, "Okay, you won't receive updates for `%s` here.", repo)
+		res := fmt.Sprintf("Okay, you won't receive updates for `%s` here.", repo)
+		if subscription.HookID != 0 {
+			hookRes, err := h.removeHook(msg.Sender.Username, *subscription)
+			if err != nil {
+				return err
+			}
+			res += " " + hookRes
+		}
+		h.ChatEcho(msg.ConvID, res)
 		return nil
 	}
 
 	h.ChatEcho(msg.ConvID, "You aren't subscribed to updates for `%s`!", repo)
 	return nil
-}
\ No newline at end of file
+}
+
+// apiClientFor returns a Gitea API client authenticated with the token
+// username gave us, or else the bot's own token. It returns nil if there is no
+// token to use.
+func (h *Handler) apiClientFor(username string) (*APIClient, error) {
+	api, err := h.userAPIClient(username)
+	if err != nil || api != nil {
+		return api, err
+	}
+	if h.giteaURL == "" || h.giteaToken == "" {
+		return nil, nil
+	}
+	return NewAPIClient(h.giteaURL, h.giteaToken), nil
+}
+
+// userAPIClient returns a Gitea API client authenticated with the token
+// username gave us. It returns nil if they haven't given one.
+func (h *Handler) userAPIClient(username string) (*APIClient, error) {
+	if h.giteaURL == "" {
+		return nil, nil
+	}
+	token, err := h.db.GetUserToken(username)
+	if err != nil {
+		return nil, fmt.Errorf("error getting token: %s", err)
+	}
+	if token == "" {
+		return nil, nil
+	}
+	return NewAPIClient(h.giteaURL, token), nil
+}
+
+// botAPIClient returns a Gitea API client using the bot's own token, or an
+// anonymous one if there is none. It returns nil if no Gitea server is set up.
+func (h *Handler) botAPIClient() *APIClient {
+	if h.giteaURL == "" {
+		return nil
+	}
+	return NewAPIClient(h.giteaURL, h.giteaToken)
+}
+
+// lookupRepo checks that repo exists on Gitea and that username can see it. It
+// is looked up with the token username gave us, or else with the bot's own (or
+// anonymously if there is none), in which case only public repos count, since
+// the bot may see far more than username. For patterns like "owner/*" the
+// owner has to be an organization. It returns repo spelled the way Gitea does
+// and its ID (0 for patterns, or when there's no Gitea to ask), or a message for
+// the conversation explaining why it can't be subscribed to.
+func (h *Handler) lookupRepo(username string, repo string) (fullName string, repoID int64, userErr string, err error) {
+	if h.giteaURL == "" {
+		return repo, 0, "", nil
+	}
+	api, err := h.userAPIClient(username)
+	if err != nil {
+		return "", 0, "", err
+	}
+	asUser := api != nil
+	if !asUser {
+		api = h.botAPIClient()
+	}
+
+	if IsRepoPattern(repo) {
+		org, err := api.GetOrg(repoOwner(repo))
+		switch {
+		case err == nil && (asUser || org.Visibility == "" || org.Visibility == "public"):
+			return org.UserName + strings.TrimPrefix(repo, repoOwner(repo)), 0, "", nil
+		case err == nil || IsNotFound(err) || IsForbidden(err):
+			return "", 0, fmt.Sprintf("I can't find an organization called `%s` on Gitea. Patterns like `owner/*` only work for organizations. "+
+				"If it's private, DM me `!gitea token <token>` so I can see it as you.", repoOwner(repo)), nil
+		default:
+			return "", 0, fmt.Sprintf("I couldn't look up `%s` on Gitea: %s", repoOwner(repo), err), nil
+		}
+	}
+
+	res, err := api.GetRepo(repo)
+	switch {
+	case err == nil && (asUser || !res.Private):
+		return res.FullName, res.ID, "", nil
+	case err == nil || IsNotFound(err) || IsForbidden(err):
+		// Gitea answers 404 for private repos we can't see, too
+		return "", 0, fmt.Sprintf("I can't find `%s` on Gitea. Check the spelling, or if it's private, DM me `!gitea token <token>` so I can see it as you.", repo), nil
+	default:
+		return "", 0, fmt.Sprintf("I couldn't look up `%s` on Gitea: %s", repo, err), nil
+	}
+}
+
+// provisionHook creates the Gitea webhook for subscription, or updates it if we
+// created one before. It returns a message for the conversation describing
+// what happened, and whether the webhook is in place. If there is no token to
+// use, the message is empty and the webhook has to be set up by hand.
+//
+// Creating a webhook used to take admin rights on the repo, and the webhook
+// streams its events into the conversation. So the bot's own token, which may
+// be an admin's, is only used for single public repos; anything else takes
+// username's own token.
+func (h *Handler) provisionHook(username string, subscription Subscription) (res string, ok bool, err error) {
+	api, err := h.userAPIClient(username)
+	if err != nil {
+		return "", false, err
+	}
+	if api == nil {
+		if h.giteaURL == "" || h.giteaToken == "" {
+			return "", false, nil
+		}
+		public, err := h.isPublicRepo(subscription.Repo)
+		if err != nil {
+			return fmt.Sprintf("I couldn't look up `%s` on Gitea: %s", subscription.Repo, err), false, nil
+		}
+		if !public {
+			return "I only set up webhooks for private repos and organizations with your own token " +
+				"(DM me `!gitea token <token>`), so this one has to be set up by hand.", false, nil
+		}
+		api = h.botAPIClient()
+	}
+
+	config := hookConfig(webhookURL(h.httpPrefix), base.MakeSecret(subscription.SecretFor(), subscription.ConvID, h.secret))
+	events := hookEvents(subscription.Events)
+	var hook *gitea.Hook
+	if subscription.HookID != 0 {
+		active := true
+		hook, err = api.EditHook(subscription.Repo, subscription.HookID, gitea.EditHookOption{
+			Config: config,
+			Events: events,
+			Active: &active,
+		})
+		if err != nil && !IsNotFound(err) {
+			return fmt.Sprintf("I couldn't update the webhook on Gitea: %s", err), false, nil
+		}
+	}
+	if hook == nil {
+		// either we never created one or it was removed on Gitea's end
+		hook, err = api.CreateHook(subscription.Repo, gitea.CreateHookOption{
+			Type:   "gitea",
+			Config: config,
+			Events: events,
+			Active: true,
+		})
+		if err != nil {
+			return fmt.Sprintf("I couldn't set up the webhook on Gitea: %s", err), false, nil
+		}
+	}
+
+	if err := h.db.UpdateSubscriptionHookID(subscription.ConvID, subscription.Repo, hook.ID); err != nil {
+		return "", false, fmt.Errorf("error saving webhook: %s", err)
+	}
+	if hook.ID == subscription.HookID {
+		return "I've updated the webhook on Gitea.", true, nil
+	}
+	return "I've set up the webhook on Gitea.", true, nil
+}
+
+// isPublicRepo reports whether repo is a single repository anyone can see.
+func (h *Handler) isPublicRepo(repo string) (bool, error) {
+	if IsRepoPattern(repo) {
+		return false, nil
+	}
+	res, err := h.botAPIClient().GetRepo(repo)
+	switch {
+	case err == nil:
+		return !res.Private, nil
+	case IsNotFound(err) || IsForbidden(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// removeHook deletes the Gitea webhook we created for subscription, returning a
+// message for the conversation describing what happened.
+func (h *Handler) removeHook(username string, subscription Subscription) (res string, err error) {
+	api, err := h.apiClientFor(username)
+	if err != nil {
+		return "", err
+	}
+	if api == nil {
+		return "Remember to remove the webhook on Gitea.", nil
+	}
+	if err := api.DeleteHook(subscription.Repo, subscription.HookID); err != nil && !IsNotFound(err) {
+		return fmt.Sprintf("I couldn't remove the webhook on Gitea: %s", err), nil
+	}
+	return "I've removed the webhook on Gitea.", nil
+}
+
+func (h *Handler) handleToken(body string, msg chat1.MsgSummary) (err error) {
+	if !base.IsDirectPrivateMessage(h.kbc.GetUsername(), msg.Sender.Username, msg.Channel) {
+		h.ChatEcho(msg.ConvID, "Please only send me Gitea tokens in a direct message. If you just posted one here, revoke it in your Gitea settings.")
+		return nil
+	}
+
+	toks, userErr, err := base.SplitTokens(body)
+	if err != nil {
+		return err
+	} else if userErr != "" {
+		h.ChatEcho(msg.ConvID, userErr)
+		return nil
+	}
+
+	args := toks[2:]
+	if len(args) != 1 {
+		h.ChatEcho(msg.ConvID, "bad args for token: expected `<token>` or `forget`")
+		return nil
+	}
+
+	if strings.ToLower(args[0]) == "forget" {
+		if err := h.db.DeleteUserToken(msg.Sender.Username); err != nil {
+			return fmt.Errorf("error deleting token: %s", err)
+		}
+		h.ChatEcho(msg.ConvID, "OK! I've forgotten your Gitea token.")
+		return nil
+	}
+
+	if h.giteaURL == "" {
+		h.ChatEcho(msg.ConvID, "I don't know which Gitea server to use, so I can't use tokens yet.")
+		return nil
+	}
+	token := args[0]
+	user, err := NewAPIClient(h.giteaURL, token).GetCurrentUser()
+	if err != nil {
+		h.ChatEcho(msg.ConvID, "That token doesn't seem to work: %s", err)
+		return nil
+	}
+	if err := h.db.SetUserToken(msg.Sender.Username, token); err != nil {
+		return fmt.Errorf("error saving token: %s", err)
+	}
+	h.ChatEcho(msg.ConvID, "Thanks! I'll act as Gitea user `%s` to set up webhooks when you subscribe.", user.UserName)
+	return nil
+}
+
+// subscribeOptions are the optional flags following the repo in `!gitea subscribe`.
+type subscribeOptions struct {
+	events      []EventType
+	eventsSet   bool
+	branches    BranchFilter
+	branchesSet bool
+	labels      LabelFilter
+	labelsSet   bool
+}
+
+func parseSubscribeOptions(args []string) (opts subscribeOptions, userErr string) {
+	fs := flag.NewFlagSet("subscribe", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	events := fs.String("events", "", "")
+	branches := fs.String("branches", "", "")
+	labels := fs.String("labels", "", "")
+	if err := fs.Parse(args); err != nil {
+		return opts, fmt.Sprintf("bad args for subscribe: %s", err)
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Sprintf("bad args for subscribe: unexpected %q", fs.Args())
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "events":
+			opts.eventsSet = true
+		case "branches":
+			opts.branchesSet = true
+		case "labels":
+			opts.labelsSet = true
+		}
+	})
+	if opts.eventsSet {
+		var err error
+		if opts.events, err = ParseEventTypes(*events); err != nil {
+			return opts, fmt.Sprintf("bad events for subscribe: %s. Pick from %s, or `all`.", err, formatEventTypes(SubscribableEventTypes))
+		}
+	}
+	if opts.branchesSet {
+		var err error
+		if opts.branches, err = ParseBranchFilter(*branches); err != nil {
+			return opts, fmt.Sprintf("bad branches for subscribe: %s. Use globs like `main,release/*,!wip/*`, or `all`.", err)
+		}
+	}
+	if opts.labelsSet {
+		var err error
+		if opts.labels, err = ParseLabelFilter(*labels); err != nil {
+			return opts, fmt.Sprintf("bad labels for subscribe: %s. Use label names like `priority/critical,bug`, or `all`.", err)
+		}
+	}
+	return opts, ""
+}
+
+func (h *Handler) handleReplay(cmd string, msg chat1.MsgSummary) (err error) {
+	toks, userErr, err := base.SplitTokens(cmd)
+	if err != nil {
+		return err
+	} else if userErr != "" {
+		h.ChatEcho(msg.ConvID, userErr)
+		return nil
+	}
+
+	args := toks[2:]
+	if len(args) != 1 {
+		h.ChatEcho(msg.ConvID, "bad args for replay: %v, expected `<delivery ID>`", args)
+		return nil
+	}
+
+	deliveryID := args[0]
+	found, err := h.db.ForgetWebhookDelivery(msg.ConvID, deliveryID)
+	if err != nil {
+		return fmt.Errorf("error forgetting delivery: %s", err)
+	}
+	if !found {
+		h.ChatEcho(msg.ConvID, "I haven't posted delivery `%s` here recently, so it will go through if you redeliver it.", deliveryID)
+		return nil
+	}
+	h.ChatEcho(msg.ConvID, "OK! Redeliver `%s` from Gitea and I'll post it here again.", deliveryID)
+	return nil
+}
+
+func (h *Handler) handleStyle(cmd string, msg chat1.MsgSummary) (err error) {
+	toks, userErr, err := base.SplitTokens(cmd)
+	if err != nil {
+		return err
+	} else if userErr != "" {
+		h.ChatEcho(msg.ConvID, userErr)
+		return nil
+	}
+
+	args := toks[2:]
+	if len(args) == 0 {
+		style, err := h.db.GetConvStyle(msg.ConvID)
+		if err != nil {
+			return fmt.Errorf("error getting style: %s", err)
+		}
+		h.ChatEcho(msg.ConvID, "Messages here are %s. Use `!gitea style <%s>` to change that.", style, joinStyles("|"))
+		return nil
+	}
+	if len(args) != 1 {
+		h.ChatEcho(msg.ConvID, "bad args for style: %v, expected `<%s>`", args, joinStyles("|"))
+		return nil
+	}
+
+	style, ok := ParseStyle(args[0])
+	if !ok {
+		h.ChatEcho(msg.ConvID, "unknown style %q, expected one of: %s", args[0], joinStyles(", "))
+		return nil
+	}
+	if err := h.db.SetConvStyle(msg.ConvID, style); err != nil {
+		return fmt.Errorf("error setting style: %s", err)
+	}
+	h.ChatEcho(msg.ConvID, "OK! Messages here will be %s from now on.", style)
+	return nil
+}
+
+func joinStyles(sep string) string {
+	names := make([]string, 0, len(Styles))
+	for _, style := range Styles {
+		names = append(names, string(style))
+	}
+	return strings.Join(names, sep)
+}
+
+func (h *Handler) handleTemplate(body string, msg chat1.MsgSummary) (err error) {
+	args := strings.TrimSpace(body[len("!gitea template"):])
+	if args == "" {
+		return h.handleListTemplates(msg)
+	}
+
+	fields := strings.Fields(args)
+	name := strings.ToLower(fields[0])
+	if !h.templates.Exists(name) {
+		h.ChatEcho(msg.ConvID, "unknown template %q, expected one of: %s", name, strings.Join(h.templates.Names(), ", "))
+		return nil
+	}
+	text := strings.TrimSpace(args[len(fields[0]):])
+
+	switch text {
+	case "":
+		custom, err := h.db.GetConvTemplate(msg.ConvID, name)
+		if err != nil {
+			return fmt.Errorf("error getting template: %s", err)
+		}
+		if custom == "" {
+			h.ChatEcho(msg.ConvID, "The `%s` template here is the default:\n%s", name, formatTemplateText(h.templates.Text(name)))
+		} else {
+			h.ChatEcho(msg.ConvID, "The `%s` template here is:\n%s", name, formatTemplateText(custom))
+		}
+		return nil
+	case "reset":
+		if err := h.db.DeleteConvTemplate(msg.ConvID, name); err != nil {
+			return fmt.Errorf("error resetting template: %s", err)
+		}
+		h.ChatEcho(msg.ConvID, "OK! I'm back to the default `%s` template here.", name)
+		return nil
+	}
+
+	text = unquoteTemplateText(text)
+	if err := h.templates.Validate(name, text); err != nil {
+		h.ChatEcho(msg.ConvID, "invalid template: %s", err)
+		return nil
+	}
+	if err := h.db.SetConvTemplate(msg.ConvID, name, text); err != nil {
+		return fmt.Errorf("error setting template: %s", err)
+	}
+	h.ChatEcho(msg.ConvID, "OK! I'll use this `%s` template here from now on. Use `!gitea template %s reset` to undo.", name, name)
+	return nil
+}
+
+func (h *Handler) handleListTemplates(msg chat1.MsgSummary) (err error) {
+	custom, err := h.db.GetConvTemplateNames(msg.ConvID)
+	if err != nil {
+		return fmt.Errorf("error getting templates: %s", err)
+	}
+	isCustom := make(map[string]bool)
+	for _, name := range custom {
+		isCustom[name] = true
+	}
+
+	var res string
+	for _, name := range h.templates.Names() {
+		if isCustom[name] {
+			res += fmt.Sprintf("- `%s` (customized here)\n", name)
+		} else {
+			res += fmt.Sprintf("- `%s`\n", name)
+		}
+	}
+	res += "\nUse `!gitea template <name>` to see one, and `!gitea template <name> <template>` to change it."
+	h.ChatEcho(msg.ConvID, "%s", res)
+	return nil
+}
+
+// formatTemplateText shows a template in a code block.
+func formatTemplateText(text string) string {
+	return "```\n" + strings.TrimSpace(text) + "\n```"
+}
+
+// unquoteTemplateText removes the code block or backticks a template was sent
+// in, so it can be pasted back as it was shown.
+func unquoteTemplateText(text string) string {
+	switch {
+	case strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") && len(text) >= 6:
+		return strings.Trim(text[3:len(text)-3], "\n")
+	case strings.HasPrefix(text, "`") && strings.HasSuffix(text, "`") && len(text) >= 2:
+		return text[1 : len(text)-1]
+	}
+	return text
+}
@@ -1,32 +1,52 @@
 package giteabot
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	gitea "code.gitea.io/gitea/modules/structs"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"github.com/keybase/managed-bots/base"
 )
 
 type HTTPSrv struct {
 	*base.HTTPSrv
 
-	kbc     *kbchat.API
-	db      *DB
-	handler *Handler
-	secret  string
+	kbc          *kbchat.API
+	db           *DB
+	handler      *Handler
+	queue        *DeliveryQueue
+	debouncer    *PushDebouncer
+	templates    *Templates
+	secret       string
+	legacySecret bool
+	dedupWindow  time.Duration
+	// forwardUnknown posts events we have no formatter for to subscriptions
+	// that want all events
+	forwardUnknown bool
 }
 
 func NewHTTPSrv(stats *base.StatsRegistry, kbc *kbchat.API, debugConfig *base.ChatDebugOutputConfig,
-	db *DB, handler *Handler, secret string) *HTTPSrv {
+	db *DB, handler *Handler, queue *DeliveryQueue, debouncer *PushDebouncer, templates *Templates,
+	secret string, legacySecret bool, dedupWindow time.Duration, forwardUnknown bool) *HTTPSrv {
 	h := &HTTPSrv{
-		kbc:     kbc,
-		db:      db,
-		handler: handler,
-		secret:  secret,
+		kbc:            kbc,
+		db:             db,
+		handler:        handler,
+		queue:          queue,
+		debouncer:      debouncer,
+		templates:      templates,
+		secret:         secret,
+		legacySecret:   legacySecret,
+		dedupWindow:    dedupWindow,
+		forwardUnknown: forwardUnknown,
 	}
 	h.HTTPSrv = base.NewHTTPSrv(stats, debugConfig)
 	http.HandleFunc("/giteabot", h.handleHealthCheck)
@@ -38,29 +58,421 @@ func (h *HTTPSrv) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "beep boop! :)")
 }
 
+// verifyPayload checks that the webhook was sent with the secret we handed out
+// for the given subscribed repo (or pattern) and conversation. Gitea signs the body with that secret in
+// the X-Gitea-Signature header. Older Gitea versions instead embed the secret
+// in the payload itself, which we only accept when legacySecret is enabled.
+func (h *HTTPSrv) verifyPayload(repo string, convID chat1.ConvIDStr, signature string, payload []byte, payloadSecret string) bool {
+	secretToken := base.MakeSecret(repo, convID, h.secret)
+	if signature != "" {
+		return ValidSignature(signature, payload, secretToken)
+	}
+	if h.legacySecret && payloadSecret != "" {
+		return subtle.ConstantTimeCompare([]byte(payloadSecret), []byte(secretToken)) == 1
+	}
+	return false
+}
+
+// webhookResponse is the JSON body returned for every webhook delivery. Gitea
+// shows it in the "Recent Deliveries" panel of the webhook settings page.
+type webhookResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+const (
+	webhookStatusAccepted = "accepted"
+	webhookStatusIgnored  = "ignored"
+	webhookStatusError    = "error"
+)
+
+func (h *HTTPSrv) respond(w http.ResponseWriter, code int, status string, msg string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	res := webhookResponse{
+		Status:  status,
+		Message: fmt.Sprintf(msg, args...),
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		h.Debug("Error writing webhook response: %s", err)
+	}
+}
+
+// trackIssueState compares the labels, milestone and assignees of an issue or
+// pull request to what we saw last time. It returns what changed, and an
+// update that records the current state.
+func (h *HTTPSrv) trackIssueState(repo string, index int64, labels []*gitea.Label, milestone *gitea.Milestone,
+	assignees []*gitea.User) (IssueChanges, StateUpdate) {
+	repo = strings.ToLower(repo)
+	cur := IssueState{
+		Labels:    labelNames(labels),
+		Milestone: milestoneTitle(milestone),
+		Assignees: userNames(assignees),
+	}
+	prev, err := h.db.GetIssueState(repo, index)
+	if err != nil {
+		h.Errorf("Error getting previous state of %s#%d: %s", repo, index, err)
+	}
+	return diffIssueState(prev, cur), setIssueState(repo, index, cur)
+}
+
+// trackCommitStatus compares the outcome of a commit status to what we last saw
+// on each branch pointing at the commit. It returns the branches where the
+// change is worth posting, and an update that records the new outcome, or nil
+// if there's nothing to record.
+func (h *HTTPSrv) trackCommitStatus(repo string, sha string, context string, outcome StatusOutcome) (changed []string, update StateUpdate) {
+	if outcome == StatusOutcomeNone {
+		return nil, nil
+	}
+	repo = strings.ToLower(repo)
+	branches, err := h.db.GetBranchesAtCommit(repo, sha)
+	if err != nil {
+		h.Errorf("Error getting branches of %s at %s: %s", repo, sha, err)
+		return nil, nil
+	}
+
+	var outdated []string
+	for _, branch := range branches {
+		prev, err := h.db.GetCommitStatusOutcome(repo, branch, context)
+		if err != nil {
+			h.Errorf("Error getting previous %q status of %s on %s: %s", context, repo, branch, err)
+			continue
+		}
+		if prev == outcome {
+			continue
+		}
+		outdated = append(outdated, branch)
+		if statusChangeWorthPosting(prev, outcome) {
+			changed = append(changed, branch)
+		}
+	}
+	if len(outdated) == 0 {
+		return changed, nil
+	}
+	return changed, setCommitStatusOutcome(repo, outdated, context, outcome)
+}
+
+// trackRepository notices a repo being renamed, transferred, archived or made
+// public or private by comparing source with what we saw last, since Gitea
+// doesn't send webhooks for those. Renamed or transferred repos are still found
+// by their ID, and their subscriptions are moved to the new name. The changes
+// are posted to the verified subscriptions, and recorded once that's queued.
+func (h *HTTPSrv) trackRepository(source *gitea.Repository, verified []Subscription, deliveryID string) error {
+	repo := strings.ToLower(source.FullName)
+	var updates []StateUpdate
+	var notices []Delivery
+
+	moved := make(map[string][]chat1.ConvIDStr)
+	var unknownID bool
+	for _, subscription := range verified {
+		switch {
+		case subscription.RepoID == source.ID && subscription.Repo != repo:
+			moved[subscription.Repo] = append(moved[subscription.Repo], subscription.ConvID)
+		case subscription.RepoID == 0 && subscription.Repo == repo:
+			unknownID = true
+		}
+	}
+	if unknownID {
+		updates = append(updates, setSubscriptionRepoID(repo, source.ID))
+	}
+	for prevRepo, convIDs := range moved {
+		updates = append(updates, renameRepo(source.ID, prevRepo, repo))
+		action := "renamed"
+		if repoOwner(prevRepo) != repoOwner(repo) {
+			action = "transferred"
+		}
+		notices = append(notices, h.renderNotices(convIDs, &Message{
+			Template: TemplateRepository,
+			Data: RepositoryData{
+				Action:   action,
+				Repo:     source.FullName,
+				PrevRepo: prevRepo,
+				URL:      source.HTMLURL,
+			},
+		})...)
+	}
+
+	prev, err := h.db.GetRepoState(source.ID)
+	if err != nil {
+		return err
+	}
+	cur := RepoState{Archived: source.Archived, Private: source.Private}
+	if prev == nil || *prev != cur {
+		updates = append(updates, setRepoState(source.ID, cur))
+	}
+	if prev != nil {
+		var actions []string
+		switch {
+		case !prev.Archived && cur.Archived:
+			actions = append(actions, "archived")
+		case prev.Archived && !cur.Archived:
+			actions = append(actions, "unarchived")
+		}
+		switch {
+		case !prev.Private && cur.Private:
+			actions = append(actions, "privatized")
+		case prev.Private && !cur.Private:
+			actions = append(actions, "publicized")
+		}
+		var wanted []chat1.ConvIDStr
+		seen := make(map[chat1.ConvIDStr]bool)
+		for _, subscription := range verified {
+			if !seen[subscription.ConvID] && subscription.WantsEvent(EventTypeRepository) {
+				wanted = append(wanted, subscription.ConvID)
+				seen[subscription.ConvID] = true
+			}
+		}
+		for _, action := range actions {
+			notices = append(notices, h.renderNotices(wanted, &Message{
+				Template: TemplateRepository,
+				Data: RepositoryData{
+					Action: action,
+					Repo:   source.FullName,
+					URL:    source.HTMLURL,
+				},
+			})...)
+		}
+	}
+
+	if len(notices) == 0 {
+		return h.db.ApplyStateUpdates(updates)
+	}
+	// the event itself is deduplicated by deliveryID, so the changes it
+	// revealed get an ID of their own
+	if deliveryID != "" {
+		deliveryID += "/repository"
+	}
+	if _, err := h.db.EnqueueDeliveries(notices, []string{deliveryID}, h.dedupWindow, updates); err != nil {
+		return err
+	}
+	h.queue.Poke()
+	return nil
+}
+
+// renderNotices renders message for each of convIDs that has something to say
+// about it.
+func (h *HTTPSrv) renderNotices(convIDs []chat1.ConvIDStr, message *Message) (deliveries []Delivery) {
+	for _, convID := range convIDs {
+		text, err := h.templates.Render(convID, message)
+		if err != nil {
+			h.Debug("Error rendering repository change for %s: %s", convID, err)
+		}
+		if text != "" {
+			deliveries = append(deliveries, Delivery{ConvID: convID, Message: text})
+		}
+	}
+	return deliveries
+}
+
+// formatPullRequestSync describes the commits pushed to a pull request since we
+// last saw it. Looking the commits up through the Gitea API is left to the
+// delivery queue, using the returned sync; the message only links to them.
+func (h *HTTPSrv) formatPullRequestSync(event *gitea.PullRequestPayload, sender string) (*Message, *PullRequestSync) {
+	repo := event.Repository.FullName
+	head := event.PullRequest.Head.Sha
+	prevHead, err := h.db.GetPullRequestHead(strings.ToLower(repo), event.PullRequest.Index)
+	if err != nil {
+		h.Errorf("Error getting previous head of %s#%d: %s", repo, event.PullRequest.Index, err)
+	}
+
+	data := PullRequestSyncData{
+		Sender: sender,
+		Repo:   repo,
+		Index:  event.PullRequest.Index,
+		Title:  event.PullRequest.Title,
+		URL:    event.PullRequest.HTMLURL,
+	}
+	if prevHead == "" || prevHead == head {
+		return &Message{Template: TemplatePullRequestSync, Data: data}, nil
+	}
+	data.CompareURL = fmt.Sprintf("%s/compare/%s...%s", event.Repository.HTMLURL, prevHead, head)
+	return &Message{Template: TemplatePullRequestSync, Data: data}, &PullRequestSync{
+		Base:           prevHead,
+		Head:           head,
+		SenderUsername: event.Sender.UserName,
+		Data:           data,
+	}
+}
+
+// webhookSource returns the repo an event is about, which is what its
+// subscriptions are looked up by, and the secret older Gitea versions embed in
+// the payload. The payload hasn't been verified yet, so anything may be
+// missing from it; repo is "" if it doesn't name one. source is the repository
+// in the payload, if it has one.
+func webhookSource(event interface{}) (repo string, source *gitea.Repository, secret string) {
+	switch event := event.(type) {
+	case *PushPayload:
+		source, secret = event.Repo, event.Secret
+	case *gitea.CreatePayload:
+		source, secret = event.Repo, event.Secret
+	case *gitea.DeletePayload:
+		source, secret = event.Repo, event.Secret
+	case *gitea.ForkPayload:
+		source, secret = event.Forkee, event.Secret
+	case *gitea.IssuePayload:
+		source, secret = event.Repository, event.Secret
+	case *gitea.IssueCommentPayload:
+		source, secret = event.Repository, event.Secret
+	case *gitea.RepositoryPayload:
+		source, secret = event.Repository, event.Secret
+	case *gitea.ReleasePayload:
+		source, secret = event.Repository, event.Secret
+	case *WikiPayload:
+		source, secret = event.Repository, event.Secret
+	case *GenericPayload:
+		source, secret = event.Repository, event.Secret
+	case *PackagePayload:
+		// packages that aren't linked to a repository are announced for their
+		// owner's repositories
+		if event.Package != nil {
+			source = event.Package.Repository
+		}
+		return event.Package.SubscriptionRepo(), source, event.Secret
+	case *CommitStatusPayload:
+		source, secret = event.Repository, event.Secret
+	case *gitea.PullRequestPayload:
+		source, secret = event.Repository, event.Secret
+	case *PullRequestReviewPayload:
+		source, secret = event.Repository, event.Secret
+	}
+	if source == nil {
+		return "", nil, secret
+	}
+	return source.FullName, source, secret
+}
+
 func (h *HTTPSrv) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respond(w, http.StatusMethodNotAllowed, webhookStatusError, "expected POST, got %s", r.Method)
+		return
+	}
+
 	payload, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		h.Errorf("Error reading payload: %s", err)
+		h.respond(w, http.StatusBadRequest, webhookStatusError, "could not read payload: %s", err)
 		return
 	}
 	defer r.Body.Close()
 
-	event, err := ParseWebhook(WebhookEventType(r), payload)
+	eventType := WebhookEventType(r)
+	if eventType == "" {
+		h.respond(w, http.StatusBadRequest, webhookStatusError, "missing %s header", eventTypeHeader)
+		return
+	}
+	event, err := ParseWebhook(eventType, payload)
+	if errors.Is(err, ErrUnknownEventType) {
+		h.Stats.Count("unknown_event")
+		h.Debug("Received unknown %q event", eventType)
+		if !h.forwardUnknown {
+			h.respond(w, http.StatusOK, webhookStatusIgnored, "unsupported event type %q", eventType)
+			return
+		}
+		event, err = ParseGenericWebhook(payload)
+	}
 	if err != nil {
-		h.Errorf("could not parse webhook: type:%v %s\n", WebhookEventType(r), err)
+		h.Errorf("could not parse webhook: type:%v %s\n", eventType, err)
+		h.respond(w, http.StatusBadRequest, webhookStatusError, "could not parse %q event: %s", eventType, err)
 		return
 	}
 
-	var message, repo, secret string
+	// nothing is looked up or recorded until the payload is known to come from
+	// a subscribed repo
+	repo, source, secret := webhookSource(event)
+	if repo == "" {
+		if _, ok := event.(*GenericPayload); ok {
+			// events we don't know needn't be about a repository
+			h.respond(w, http.StatusOK, webhookStatusIgnored, "nothing to announce for %q event", eventType)
+			return
+		}
+		h.respond(w, http.StatusBadRequest, webhookStatusError, "payload has no repository")
+		return
+	}
+	repo = strings.ToLower(repo)
+	subscriptions, err := h.db.GetSubscribedConvs(repo)
+	if err != nil {
+		h.Errorf("Error getting subscriptions for repo: %s", err)
+		h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not look up subscriptions")
+		return
+	}
+	// subscriptions follow a repo by its ID, so they're still found under the
+	// name the repo had before it was renamed or transferred
+	if source != nil && source.ID != 0 {
+		moved, err := h.db.GetMovedSubscriptions(source.ID, repo)
+		if err != nil {
+			h.Errorf("Error getting moved subscriptions for repo: %s", err)
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not look up subscriptions")
+			return
+		}
+		subscriptions = append(subscriptions, moved...)
+	}
+	if len(subscriptions) == 0 {
+		h.respond(w, http.StatusNotFound, webhookStatusError, "no conversation is subscribed to %s", repo)
+		return
+	}
+
+	signature := WebhookSignature(r)
+	var verified []Subscription
+	for _, subscription := range subscriptions {
+		if !h.verifyPayload(subscription.SecretFor(), subscription.ConvID, signature, payload, secret) {
+			h.Debug("Error validating payload signature for conversation %s", subscription.ConvID)
+			continue
+		}
+		verified = append(verified, subscription)
+	}
+
+	switch {
+	case len(verified) > 0:
+	case signature == "" && !h.legacySecret:
+		h.respond(w, http.StatusUnauthorized, webhookStatusError, "missing %s header", signatureHeader)
+		return
+	case signature == "":
+		h.respond(w, http.StatusUnauthorized, webhookStatusError, "payload secret does not match any subscription")
+		return
+	default:
+		h.respond(w, http.StatusForbidden, webhookStatusError, "signature does not match any subscription")
+		return
+	}
+
+	if source != nil && source.ID != 0 {
+		if err := h.trackRepository(source, verified, WebhookDeliveryID(r)); err != nil {
+			h.Errorf("Error tracking changes to %s: %s", repo, err)
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not queue message")
+			return
+		}
+	}
+
+	// branches are only set for events that happen on a branch, and are
+	// matched against the subscriptions' branch filters
+	var message *Message
+	var branches []string
+	// itemIndex is the issue or pull request the event is about, if any.
+	// Messages about the same item are threaded together.
+	var itemIndex int64
+	// card is the item's status card, for events that change it
+	var card *Message
+	// push is set for push events, which may be debounced
+	var push *PushData
+	// sync is set for pull request updates, whose new commits are looked up
+	// once they're being delivered
+	var sync *PullRequestSync
+	// updates record what we learned from the event. They're only applied
+	// once the event's deliveries are queued, so a failed delivery can be
+	// redelivered and compared against the same state.
+	var updates []StateUpdate
+	var update StateUpdate
+	// label changes are matched against the subscriptions' label filters
+	var isLabelChange bool
+	var addedLabels []string
 
 	// Event types are defined in gitea/modules/structs/hook.go as xxxxPayload
 	//   https://github.com/go-gitea/gitea/blob/master/modules/structs/hook.go
 	switch event := event.(type) {
-	case *gitea.PushPayload:
+	case *PushPayload:
 		// Gitea will send a bogus "push" event when a release is created
 		// Ignore these, since they're not real commits/pushes
 		if len(event.Commits) == 0 {
+			h.respond(w, http.StatusOK, webhookStatusIgnored, "push without commits")
 			return
 		}
 
@@ -69,43 +481,59 @@ func (h *HTTPSrv) handleWebhook(w http.ResponseWriter, r *http.Request) {
 			pusher = event.Pusher.UserName
 		}
 
-		message = FormatPushMsg(
-			pusher,
-			event.Repo.FullName,
-			refToBranch(event.Ref),
-			len(event.Commits),
-			getCommitMessages(event),
-			event.Commits[len(event.Commits)-1].URL,
-		)
+		push = &PushData{
+			Pusher:     pusher,
+			Repo:       event.Repo.FullName,
+			Branch:     refToBranch(event.Ref),
+			NumPushes:  1,
+			NumCommits: event.NumCommits(),
+			Commits:    getCommits(event),
+			CommitURL:  event.Commits[len(event.Commits)-1].URL,
+			CompareURL: event.CompareURL,
+			Before:     event.Before,
+			After:      event.After,
+		}
+		message = &Message{Template: TemplatePush, Data: *push}
 
-		repo = event.Repo.FullName
-		secret = event.Secret
+		branch := refToBranch(event.Ref)
+		branches = []string{branch}
+
+		// remember branch heads, so commit statuses can be tied to branches
+		updates = append(updates, setBranchHead(strings.ToLower(event.Repo.FullName), branch, event.After))
 	case *gitea.CreatePayload:
-		message = FormatCreateMsg(
-			event.Ref,
-			event.RefType,
-			event.Repo.FullName,
-		)
+		message = &Message{
+			Template: TemplateCreate,
+			Data: RefData{
+				Ref:     event.Ref,
+				RefType: event.RefType,
+				Repo:    event.Repo.FullName,
+			},
+		}
 
-		repo = event.Repo.FullName
-		secret = event.Secret
+		if event.RefType == "branch" {
+			branches = []string{event.Ref}
+		}
 	case *gitea.DeletePayload:
-		message = FormatDeleteMsg(
-			event.Ref,
-			event.RefType,
-			event.Repo.FullName,
-		)
+		message = &Message{
+			Template: TemplateDelete,
+			Data: RefData{
+				Ref:     event.Ref,
+				RefType: event.RefType,
+				Repo:    event.Repo.FullName,
+			},
+		}
 
-		repo = event.Repo.FullName
-		secret = event.Secret
+		if event.RefType == "branch" {
+			branches = []string{event.Ref}
+		}
 	case *gitea.ForkPayload:
-		message = FormatForkMsg(
-			event.Forkee.FullName,
-			event.Repo.FullName,
-			)
-
-		repo = event.Forkee.FullName
-		secret = event.Secret
+		message = &Message{
+			Template: TemplateFork,
+			Data: ForkData{
+				Repo: event.Forkee.FullName,
+				Fork: event.Repo.FullName,
+			},
+		}
 	case *gitea.IssuePayload:
 		var assignee string
 
@@ -121,67 +549,175 @@ func (h *HTTPSrv) handleWebhook(w http.ResponseWriter, r *http.Request) {
 			sender = event.Sender.UserName
 		}
 
-		message = FormatIssueMsg(
-			event.Action,
-			sender,
-			event.Issue.Index,
+		var changes IssueChanges
+		changes, update = h.trackIssueState(
 			event.Repository.FullName,
-			assignee,
-			event.Issue.Title,
-			event.Issue.URL,
+			event.Issue.Index,
+			event.Issue.Labels,
+			event.Issue.Milestone,
+			event.Issue.Assignees,
 		)
+		updates = append(updates, update)
+		isLabelChange = event.Action == gitea.HookIssueLabelUpdated || event.Action == gitea.HookIssueLabelCleared
+		addedLabels = changes.AddedLabels
+
+		message = &Message{
+			Template: TemplateIssues,
+			Data: IssueData{
+				Kind:     "issue",
+				Action:   string(event.Action),
+				Sender:   sender,
+				Repo:     event.Repository.FullName,
+				Index:    event.Issue.Index,
+				Title:    event.Issue.Title,
+				Assignee: assignee,
+				URL:      event.Issue.URL,
+				Changes:  changes,
+			},
+		}
 
-		repo = event.Repository.FullName
-		secret = event.Secret
+		itemIndex = event.Issue.Index
+		card = &Message{Template: TemplateCard, Data: StatusCard{
+			Kind:      "issue",
+			Repo:      event.Repository.FullName,
+			Index:     event.Issue.Index,
+			Title:     event.Issue.Title,
+			State:     itemState(event.Issue.State, false),
+			Author:    userName(event.Issue.Poster),
+			Assignees: userNames(event.Issue.Assignees),
+			Labels:    labelNames(event.Issue.Labels),
+			Milestone: milestoneTitle(event.Issue.Milestone),
+			URL:       fmt.Sprintf("%s/issues/%d", event.Repository.HTMLURL, event.Issue.Index),
+		}}
 	case *gitea.IssueCommentPayload:
 		poster := event.Comment.Poster.FullName
 		if len(poster) == 0 {
 			poster = event.Comment.Poster.UserName
 		}
 
-		message = FormatIssueCommentMsg(
-			event.Action,
-			poster,
-			event.Issue.Index,
-			event.Repository.FullName,
-			event.Comment.Body,
-			event.Issue.Title,
-			event.Comment.HTMLURL,
-		)
+		message = &Message{
+			Template: TemplateIssueComment,
+			Data: IssueCommentData{
+				Action: string(event.Action),
+				Poster: poster,
+				Repo:   event.Repository.FullName,
+				Index:  event.Issue.Index,
+				Title:  event.Issue.Title,
+				Body:   event.Comment.Body,
+				URL:    event.Comment.HTMLURL,
+			},
+		}
 
-		repo = event.Repository.FullName
-		secret = event.Secret
+		itemIndex = event.Issue.Index
 	case *gitea.RepositoryPayload:
 		sender := event.Sender.FullName
 		if len(sender) == 0 {
 			sender = event.Sender.UserName
 		}
 
-		message = FormatRepositoryMsg(
-			event.Action,
-			sender,
-			event.Repository.FullName,
-		)
-
-		repo = event.Repository.FullName
-		secret = event.Secret
+		message = &Message{
+			Template: TemplateRepository,
+			Data: RepositoryData{
+				Action: string(event.Action),
+				Sender: sender,
+				Repo:   event.Repository.FullName,
+				URL:    event.Repository.HTMLURL,
+			},
+		}
 	case *gitea.ReleasePayload:
 		sender := event.Sender.FullName
 		if len(sender) == 0 {
 			sender = event.Sender.UserName
 		}
 
-		message = FormatReleaseMsg(
-			event.Action,
-			sender,
-			event.Repository.FullName,
-			event.Release.Title,
-			event.Release.TagName,
-			event.Release.TarURL,
-		)
+		message = &Message{
+			Template: TemplateRelease,
+			Data: ReleaseData{
+				Action: string(event.Action),
+				Sender: sender,
+				Repo:   event.Repository.FullName,
+				Title:  event.Release.Title,
+				Tag:    event.Release.TagName,
+				URL:    event.Release.TarURL,
+			},
+		}
+	case *WikiPayload:
+		sender := event.Sender.FullName
+		if len(sender) == 0 {
+			sender = event.Sender.UserName
+		}
+
+		message = &Message{
+			Template: TemplateWiki,
+			Data: WikiData{
+				Action:  string(event.Action),
+				Sender:  sender,
+				Repo:    event.Repository.FullName,
+				Page:    event.Page,
+				Comment: event.Comment,
+				URL:     wikiPageURL(event.Repository.HTMLURL, event.Page),
+			},
+		}
+	case *GenericPayload:
+		if event.Repository == nil {
+			break
+		}
+		var sender string
+		if event.Sender != nil {
+			sender = event.Sender.FullName
+			if len(sender) == 0 {
+				sender = event.Sender.UserName
+			}
+		}
+
+		message = &Message{
+			Template: TemplateUnknown,
+			Data: GenericData{
+				EventType: string(eventType),
+				Event:     strings.Replace(string(eventType), "_", " ", -1),
+				Action:    event.Action,
+				Sender:    sender,
+				Repo:      event.Repository.FullName,
+				URL:       event.Repository.HTMLURL,
+			},
+		}
+	case *PackagePayload:
+		sender := event.Sender.FullName
+		if len(sender) == 0 {
+			sender = event.Sender.UserName
+		}
 
-		repo = event.Repository.FullName
-		secret = event.Secret
+		message = &Message{
+			Template: TemplatePackage,
+			Data: PackageData{
+				Action:  string(event.Action),
+				Sender:  sender,
+				Type:    event.Package.Type,
+				Name:    event.Package.Name,
+				Version: event.Package.Version,
+				URL:     event.Package.HTMLURL,
+			},
+		}
+	case *CommitStatusPayload:
+		outcome := statusOutcome(event.State)
+		branches, update = h.trackCommitStatus(event.Repository.FullName, event.SHA, event.Context, outcome)
+		if update != nil {
+			updates = append(updates, update)
+		}
+		if len(branches) > 0 {
+			message = &Message{
+				Template: TemplateStatus,
+				Data: StatusData{
+					Outcome:     string(outcome),
+					Context:     event.Context,
+					Description: event.Description,
+					Repo:        event.Repository.FullName,
+					Branches:    branches,
+					SHA:         event.SHA,
+					URL:         event.TargetURL,
+				},
+			}
+		}
 	case *gitea.PullRequestPayload:
 		var assignee string
 
@@ -199,38 +735,195 @@ func (h *HTTPSrv) handleWebhook(w http.ResponseWriter, r *http.Request) {
 			sender = event.Sender.UserName
 		}
 
-		message = FormatPullRequestMsg(
-			event.Action,
-			sender,
+		var changes IssueChanges
+		changes, update = h.trackIssueState(
 			event.Repository.FullName,
 			event.PullRequest.Index,
-			event.PullRequest.Title,
-			source,
-			assignee,
-			event.PullRequest.URL,
+			event.PullRequest.Labels,
+			event.PullRequest.Milestone,
+			event.PullRequest.Assignees,
 		)
+		updates = append(updates, update)
+		isLabelChange = event.Action == gitea.HookIssueLabelUpdated || event.Action == gitea.HookIssueLabelCleared
+		addedLabels = changes.AddedLabels
+
+		if event.Action == gitea.HookIssueSynchronized {
+			message, sync = h.formatPullRequestSync(event, sender)
+		} else {
+			message = &Message{
+				Template: TemplatePullRequest,
+				Data: IssueData{
+					Kind:     "PR",
+					Action:   string(event.Action),
+					Sender:   sender,
+					Repo:     event.Repository.FullName,
+					Index:    event.PullRequest.Index,
+					Title:    event.PullRequest.Title,
+					Assignee: assignee,
+					Source:   source,
+					URL:      event.PullRequest.URL,
+					Changes:  changes,
+				},
+			}
+		}
+
+		itemIndex = event.PullRequest.Index
+		if event.Action != gitea.HookIssueSynchronized {
+			card = &Message{Template: TemplateCard, Data: StatusCard{
+				Kind:      "PR",
+				Repo:      event.Repository.FullName,
+				Index:     event.PullRequest.Index,
+				Title:     event.PullRequest.Title,
+				State:     itemState(event.PullRequest.State, event.PullRequest.HasMerged),
+				Author:    userName(event.PullRequest.Poster),
+				Source:    source,
+				Assignees: userNames(event.PullRequest.Assignees),
+				Labels:    labelNames(event.PullRequest.Labels),
+				Milestone: milestoneTitle(event.PullRequest.Milestone),
+				URL:       event.PullRequest.HTMLURL,
+			}}
+		}
+		updates = append(updates, setPullRequestHead(strings.ToLower(event.Repository.FullName),
+			event.PullRequest.Index, event.PullRequest.Head.Sha))
+	case *PullRequestReviewPayload:
+		reviewer := event.Sender.FullName
+		if len(reviewer) == 0 {
+			reviewer = event.Sender.UserName
+		}
+
+		var review string
+		if event.Review != nil {
+			review = event.Review.Content
+		}
 
-		repo = event.Repository.FullName
-		secret = event.Secret
+		message = &Message{
+			Template: TemplatePullRequestReview,
+			Data: ReviewData{
+				Type:     string(eventType),
+				Reviewer: reviewer,
+				Repo:     event.Repository.FullName,
+				Index:    event.PullRequest.Index,
+				Title:    event.PullRequest.Title,
+				Review:   review,
+				URL:      event.PullRequest.HTMLURL + "/files",
+			},
+		}
+
+		itemIndex = event.PullRequest.Index
 	}
 
-	if message == "" || repo == "" {
+	// actions without a message in the default template aren't announced
+	if message != nil {
+		text, err := h.templates.RenderDefault(message)
+		if err != nil {
+			h.Errorf("Error rendering %q event: %s", eventType, err)
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not render message")
+			return
+		}
+		if text == "" {
+			message = nil
+		}
+	}
+	if message == nil {
+		h.ignoreAndRecord(w, eventType, updates, "nothing to announce for %q event", eventType)
 		return
 	}
 
-	repo = strings.ToLower(repo)
-	convs, err := h.db.GetSubscribedConvs(repo)
-	if err != nil {
-		h.Errorf("Error getting subscriptions for repo: %s", err)
+	// a conversation may be subscribed to both the repo and a pattern covering it
+	var wanted []chat1.ConvIDStr
+	seen := make(map[chat1.ConvIDStr]bool)
+	for _, subscription := range verified {
+		if seen[subscription.ConvID] {
+			continue
+		}
+		if subscription.WantsEvent(eventType) &&
+			(len(branches) == 0 || subscription.WantsAnyBranch(branches)) &&
+			(!isLabelChange || subscription.WantsLabels(addedLabels)) {
+			wanted = append(wanted, subscription.ConvID)
+			seen[subscription.ConvID] = true
+		}
+	}
+	if len(wanted) == 0 {
+		h.ignoreAndRecord(w, eventType, updates, "no conversation wants this %q event for %s", eventType, repo)
 		return
 	}
 
-	for _, convID := range convs {
-		var secretToken = base.MakeSecret(repo, convID, h.secret)
-		if secret != secretToken {
-			h.Debug("Error validating payload signature for conversation %s: %v", convID, err)
+	deliveryID := WebhookDeliveryID(r)
+	if push != nil && h.debouncer.Enabled() {
+		// the delivery is only recorded once its batch is queued, so Gitea can
+		// redeliver it if the bot goes away before then
+		unseen, err := h.db.UnseenWebhookDeliveries(wanted, deliveryID, h.dedupWindow)
+		if err != nil {
+			h.Errorf("Error checking deliveries: %s", err)
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not queue message")
+			return
+		}
+		if len(unseen) == 0 {
+			h.respond(w, http.StatusOK, webhookStatusIgnored, "delivery %s was already posted", deliveryID)
+			return
+		}
+		if err := h.db.ApplyStateUpdates(updates); err != nil {
+			h.Errorf("Error recording %q event: %s", eventType, err)
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not queue message")
+			return
+		}
+		h.debouncer.Add(unseen, *push, deliveryID)
+		h.respond(w, http.StatusAccepted, webhookStatusAccepted, "batched for %d conversation(s)", len(unseen))
+		return
+	}
+
+	var deliveries []Delivery
+	var renderFailed bool
+	for _, convID := range wanted {
+		text, err := h.templates.Render(convID, message)
+		if err != nil {
+			h.Debug("Error rendering %q event for %s: %s", eventType, convID, err)
+			renderFailed = true
+		}
+		if text == "" {
 			continue
 		}
-		h.ChatEcho(convID, message)
+		delivery := Delivery{ConvID: convID, Message: text, Sync: sync}
+		if itemIndex != 0 {
+			delivery.Thread = Thread{Repo: repo, Index: itemIndex}
+			if card != nil {
+				if delivery.Thread.Card, err = h.templates.Render(convID, card); err != nil {
+					h.Debug("Error rendering card for %s: %s", convID, err)
+				}
+			}
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if len(deliveries) == 0 {
+		if renderFailed {
+			h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not render message")
+			return
+		}
+		h.ignoreAndRecord(w, eventType, updates, "nothing to announce for %q event", eventType)
+		return
+	}
+	queued, err := h.db.EnqueueDeliveries(deliveries, []string{deliveryID}, h.dedupWindow, updates)
+	if err != nil {
+		h.Errorf("Error queueing deliveries: %s", err)
+		h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not queue message")
+		return
+	}
+	if len(queued) == 0 {
+		h.respond(w, http.StatusOK, webhookStatusIgnored, "delivery %s was already posted", deliveryID)
+		return
+	}
+	h.queue.Poke()
+	h.respond(w, http.StatusAccepted, webhookStatusAccepted, "queued for %d conversation(s)", len(queued))
+}
+
+// ignoreAndRecord answers an event that nothing is posted for, after recording
+// what we learned from it.
+func (h *HTTPSrv) ignoreAndRecord(w http.ResponseWriter, eventType EventType, updates []StateUpdate,
+	format string, args ...interface{}) {
+	if err := h.db.ApplyStateUpdates(updates); err != nil {
+		h.Errorf("Error recording %q event: %s", eventType, err)
+		h.respond(w, http.StatusInternalServerError, webhookStatusError, "could not record event")
+		return
 	}
+	h.respond(w, http.StatusOK, webhookStatusIgnored, format, args...)
 }
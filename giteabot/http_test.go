@@ -0,0 +1,138 @@
+package giteabot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/managed-bots/base"
+)
+
+const (
+	testBotSecret = "some_nonce"
+	testConvID    = chat1.ConvIDStr("0000f0b5e6dd4d3bcb2f42ad9d6d8d3a0b7a2e3c1f0c5c0e7e2bbbd9d5b2a0a1")
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	payload, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyPayload(t *testing.T) {
+	payload := readFixture(t, "push.json")
+	event, err := ParseWebhook(EventTypePush, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := event.(*PushPayload).Repo.FullName
+	secretToken := base.MakeSecret(repo, testConvID, testBotSecret)
+	tampered := bytes.Replace(payload, []byte("sys-usb"), []byte("sys-net"), -1)
+
+	tests := []struct {
+		name          string
+		legacySecret  bool
+		body          []byte
+		signature     string
+		payloadSecret string
+		valid         bool
+	}{
+		{name: "signed", body: payload, signature: sign(payload, secretToken), valid: true},
+		{name: "tampered body", body: tampered, signature: sign(payload, secretToken)},
+		{name: "wrong secret", body: payload, signature: sign(payload, base.MakeSecret(repo, testConvID, "other"))},
+		{name: "other conversation", body: payload,
+			signature: sign(payload, base.MakeSecret(repo, chat1.ConvIDStr("other"), testBotSecret))},
+		{name: "malformed signature", body: payload, signature: "not hex"},
+		{name: "missing header", body: payload},
+		{name: "missing header with legacy secret", legacySecret: true, body: payload},
+		{name: "legacy secret disabled", body: payload, payloadSecret: secretToken},
+		{name: "legacy secret", legacySecret: true, body: payload, payloadSecret: secretToken, valid: true},
+		{name: "wrong legacy secret", legacySecret: true, body: payload, payloadSecret: "guess"},
+		{name: "signature wins over legacy secret", legacySecret: true, body: tampered,
+			signature: sign(payload, secretToken), payloadSecret: secretToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/giteabot/webhook", bytes.NewReader(test.body))
+			r.Header.Set(eventTypeHeader, string(EventTypePush))
+			if test.signature != "" {
+				r.Header.Set(signatureHeader, test.signature)
+			}
+
+			h := &HTTPSrv{secret: testBotSecret, legacySecret: test.legacySecret}
+			valid := h.verifyPayload(repo, testConvID, WebhookSignature(r), test.body, test.payloadSecret)
+			if valid != test.valid {
+				t.Errorf("verifyPayload() = %v, want %v", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestWebhookSourceWithoutRepository(t *testing.T) {
+	for _, eventType := range []EventType{
+		EventTypeCreate, EventTypeDelete, EventTypeFork, EventTypePush, EventTypeIssues,
+		EventTypeIssueComment, EventTypeRepository, EventTypeRelease, EventTypePullRequest,
+		EventTypePullRequestApproved, EventTypeWiki, EventTypeStatus, EventTypePackage,
+	} {
+		t.Run(string(eventType), func(t *testing.T) {
+			event, err := ParseWebhook(eventType, []byte(`{"secret": "guess"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repo, _, _ := webhookSource(event); repo != "" {
+				t.Errorf("webhookSource() = %q, want \"\"", repo)
+			}
+		})
+	}
+}
+
+func TestWebhookSource(t *testing.T) {
+	event, err := ParseWebhook(EventTypePush, readFixture(t, "push.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, source, _ := webhookSource(event)
+	if repo != "vlad/Managed-Qubes" {
+		t.Errorf("webhookSource() repo = %q, want %q", repo, "vlad/Managed-Qubes")
+	}
+	// subscriptions follow the repo by its ID across renames
+	if source == nil || source.ID != 140 {
+		t.Errorf("webhookSource() source = %+v, want ID 140", source)
+	}
+}
+
+func TestPushNumCommits(t *testing.T) {
+	payload := readFixture(t, "push.json")
+	tests := []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"without total", payload, 1},
+		{"trimmed commits", bytes.Replace(payload, []byte(`"secret": "",`), []byte(`"secret": "", "total_commits": 42,`), 1), 42},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := ParseWebhook(EventTypePush, test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := event.(*PushPayload).NumCommits(); got != test.want {
+				t.Errorf("NumCommits() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package giteabot
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Issue titles, comments, commit messages and so on are written by whoever
+// has access to the repository, and are posted into conversations that may
+// have many more members. They are escaped so they show up as typed instead of
+// breaking the formatting of the message around them, and so they can't ping
+// anyone.
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"~", `\~`,
+	"`", "\\`",
+)
+
+// EscapeMarkdown escapes the characters Keybase chat treats as markdown in
+// text, and neutralizes any @mentions in it.
+func EscapeMarkdown(text string) string {
+	lines := strings.Split(markdownEscaper.Replace(text), "\n")
+	for i, line := range lines {
+		// quotes only start at the beginning of a line
+		if trimmed := strings.TrimLeft(line, " \t"); strings.HasPrefix(trimmed, ">") {
+			lines[i] = line[:len(line)-len(trimmed)] + `\` + trimmed
+		}
+	}
+	return NeutralizeMentions(strings.Join(lines, "\n"))
+}
+
+// formatCode wraps text in a code span. Markdown isn't rendered in code spans,
+// so only backticks, which would end the span early, need replacing.
+func formatCode(text string) string {
+	return "`" + strings.Replace(NeutralizeMentions(text), "`", "\u02cb", -1) + "`"
+}
+
+// zeroWidthSpace is invisible, but stops Keybase from seeing a mention.
+const zeroWidthSpace = "\u200b"
+
+var (
+	wordRegexp    = regexp.MustCompile(`\S+`)
+	mentionRegexp = regexp.MustCompile(`(^|[^\w])@(\w)`)
+)
+
+// NeutralizeMentions breaks up anything in text Keybase would turn into a
+// mention, like @here, @channel or @username, without changing how it looks.
+// Email addresses and URLs are left alone.
+func NeutralizeMentions(text string) string {
+	return wordRegexp.ReplaceAllStringFunc(text, func(word string) string {
+		if strings.Contains(word, "://") {
+			return word
+		}
+		return mentionRegexp.ReplaceAllString(word, "${1}@"+zeroWidthSpace+"${2}")
+	})
+}
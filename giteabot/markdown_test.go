@@ -0,0 +1,115 @@
+package giteabot
+
+import "testing"
+
+func TestEscapeMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Fix the salt states", "Fix the salt states"},
+		{"backticks", "run `rm -rf /` now", "run \\`rm -rf /\\` now"},
+		{"code fence", "```\ncode\n```", "\\`\\`\\`\ncode\n\\`\\`\\`"},
+		{"bold", "*urgent*", `\*urgent\*`},
+		{"italic", "_maybe_", `\_maybe\_`},
+		{"strikethrough", "~never~", `\~never\~`},
+		{"backslash", `C:\*`, `C:\\\*`},
+		{"quote", "> quoted", `\> quoted`},
+		{"quote after whitespace", "  > quoted", `  \> quoted`},
+		{"quote on a later line", "see\n\t> quoted", "see\n\t\\> quoted"},
+		{"greater than mid-line", "a > b", "a > b"},
+		{"here", "@here look", "@\u200bhere look"},
+		{"channel mid-line", "ping @channel now", "ping @\u200bchannel now"},
+		{"user", "thanks @vlad!", "thanks @\u200bvlad!"},
+		{"mention on a later line", "hi\n@everyone", "hi\n@\u200beveryone"},
+		{"mention in parentheses", "(@vlad)", "(@\u200bvlad)"},
+		{"mention mid-word", "foo@here", "foo@here"},
+		{"email", "mail vlad@example.com", "mail vlad@example.com"},
+		{"url", "see https://git.internal/-/packages/npm/@scope%2Fpkg", "see https://git.internal/-/packages/npm/@scope%2Fpkg"},
+		{"mentions and markdown", "*@here*", `\*@` + "\u200b" + `here\*`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := EscapeMarkdown(test.in); got != test.want {
+				t.Errorf("EscapeMarkdown(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNeutralizeMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"start of line", "@here", "@\u200bhere"},
+		{"start of later line", "a\n@channel", "a\n@\u200bchannel"},
+		{"mid-line", "cc @vlad", "cc @\u200bvlad"},
+		{"mid-word", "foo@channel", "foo@channel"},
+		{"double at", "@@here", "@@\u200bhere"},
+		{"email", "vlad@example.com", "vlad@example.com"},
+		{"url", "https://git.internal/@vlad", "https://git.internal/@vlad"},
+		{"lone at", "meet @ 5", "meet @ 5"},
+		{"already neutralized", "@\u200bhere", "@\u200bhere"},
+		{"markdown untouched", "*@here*", "*@\u200bhere*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NeutralizeMentions(test.in); got != test.want {
+				t.Errorf("NeutralizeMentions(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatCode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "ci/drone", "`ci/drone`"},
+		{"markdown kept", "*_~", "`*_~`"},
+		{"backticks", "a `b` c", "`a \u02cbb\u02cb c`"},
+		{"closing early", "`", "`\u02cb`"},
+		{"mention", "@here", "`@\u200bhere`"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatCode(test.in); got != test.want {
+				t.Errorf("formatCode(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIssueCommentEscaping(t *testing.T) {
+	templates, err := NewTemplates(nil, "", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{
+		Template: TemplateIssueComment,
+		Data: IssueCommentData{
+			Action: "created",
+			Poster: "mal_lory",
+			Repo:   "vlad/Managed-Qubes",
+			Index:  7,
+			Title:  "`broken` *title* @here",
+			Body:   "@channel look:\n```\nrm -rf ~\n```\n  > quoted reply, dropped\nmail vlad@example.com",
+			URL:    "https://git.internal/vlad/Managed-Qubes/issues/7#issuecomment-1",
+		},
+	}
+	want := "mal\\_lory commented on issue \"\\`broken\\` \\*title\\* @\u200bhere\" (#7) on vlad/Managed-Qubes:\n" +
+		"@\u200bchannel look:\n\\`\\`\\`\nrm -rf \\~\n\\`\\`\\`\nmail vlad@example.com\n" +
+		"https://git.internal/vlad/Managed-Qubes/issues/7#issuecomment-1"
+	got, err := templates.RenderDefault(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("RenderDefault() = %q, want %q", got, want)
+	}
+}
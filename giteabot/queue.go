@@ -0,0 +1,266 @@
+package giteabot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/managed-bots/base"
+)
+
+const (
+	queuePollInterval = 5 * time.Second
+	queueLease        = time.Minute
+	queueBaseBackoff  = 5 * time.Second
+	queueMaxBackoff   = time.Hour
+	maxSyncCommits    = 50
+)
+
+// PullRequestSync is a pull request update whose new commits are looked up
+// through the Gitea API when it's delivered, rather than while Gitea waits for
+// the webhook response.
+type PullRequestSync struct {
+	Base string
+	Head string
+	// SenderUsername is the Gitea account of who pushed the commits
+	SenderUsername string
+	Data           PullRequestSyncData
+}
+
+// DeliveryQueue drains the delivery_queue table, sending each queued message to
+// its conversation from a pool of workers. Workers serve different
+// conversations in parallel, but each conversation's messages are sent in order.
+// Failed sends are retried with exponential backoff, and dead-lettered once they
+// run out of attempts.
+type DeliveryQueue struct {
+	*base.DebugOutput
+
+	stats       *base.StatsRegistry
+	kbc         *kbchat.API
+	db          *DB
+	handler     *Handler
+	templates   *Templates
+	workers     int
+	maxAttempts int
+
+	pokeCh       chan struct{}
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewDeliveryQueue(stats *base.StatsRegistry, kbc *kbchat.API, debugConfig *base.ChatDebugOutputConfig,
+	db *DB, handler *Handler, templates *Templates, workers int, maxAttempts int) *DeliveryQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &DeliveryQueue{
+		DebugOutput: base.NewDebugOutput("DeliveryQueue", debugConfig),
+		stats:       stats.SetPrefix("DeliveryQueue"),
+		kbc:         kbc,
+		db:          db,
+		handler:     handler,
+		templates:   templates,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		pokeCh:      make(chan struct{}, 1),
+		shutdownCh:  make(chan struct{}),
+	}
+}
+
+// Poke lets the queue know new deliveries are waiting, so it doesn't have to
+// wait for the next poll to pick them up.
+func (q *DeliveryQueue) Poke() {
+	select {
+	case q.pokeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *DeliveryQueue) Listen() error {
+	deliveryCh := make(chan Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range deliveryCh {
+				q.deliver(delivery)
+			}
+		}()
+	}
+	defer func() {
+		close(deliveryCh)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		deliveries, err := q.db.ClaimDeliveries(q.workers, queueLease)
+		if err != nil {
+			q.Errorf("unable to claim deliveries: %s", err)
+		}
+		for _, delivery := range deliveries {
+			select {
+			case deliveryCh <- delivery:
+			case <-q.shutdownCh:
+				// anything claimed but not sent is picked up again once its
+				// lease runs out
+				return nil
+			}
+		}
+		if len(deliveries) == q.workers {
+			// there may be more waiting
+			continue
+		}
+
+		select {
+		case <-q.shutdownCh:
+			return nil
+		case <-q.pokeCh:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *DeliveryQueue) Shutdown() error {
+	q.shutdownOnce.Do(func() {
+		close(q.shutdownCh)
+	})
+	return nil
+}
+
+func (q *DeliveryQueue) deliver(delivery Delivery) {
+	err := q.send(delivery)
+	if err == nil {
+		q.stats.Count("deliver")
+		if err := q.db.CompleteDelivery(delivery.ID); err != nil {
+			q.Errorf("unable to remove delivery %d from the queue: %s", delivery.ID, err)
+		}
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= q.maxAttempts {
+		q.stats.Count("deadletter")
+		q.Errorf("giving up on delivery %d to %s after %d attempts: %s", delivery.ID, delivery.ConvID, attempts, err)
+		if err := q.db.DeadLetterDelivery(delivery.ID, attempts, err.Error()); err != nil {
+			q.Errorf("unable to dead-letter delivery %d: %s", delivery.ID, err)
+		}
+		return
+	}
+
+	q.stats.Count("retry")
+	backoff := retryBackoff(attempts)
+	q.Debug("delivery %d to %s failed (attempt %d), retrying in %s: %s", delivery.ID, delivery.ConvID, attempts, backoff, err)
+	if err := q.db.RetryDelivery(delivery.ID, attempts, backoff, err.Error()); err != nil {
+		q.Errorf("unable to reschedule delivery %d: %s", delivery.ID, err)
+	}
+}
+
+// send posts a delivery to its conversation. Messages about an issue or pull
+// request are posted as replies to the first message about it, and become that
+// first message when there isn't one yet. Changes to the item's state are
+// edited into its status card instead.
+func (q *DeliveryQueue) send(delivery Delivery) error {
+	if delivery.Sync != nil {
+		delivery.Message = q.syncMessage(delivery)
+	}
+	thread := delivery.Thread
+	if thread.Index == 0 {
+		_, err := q.kbc.SendMessageByConvID(delivery.ConvID, "%s", delivery.Message)
+		return err
+	}
+
+	root, isCard, err := q.db.GetThreadMessage(delivery.ConvID, thread)
+	if err != nil {
+		// not worth holding the message back for
+		q.Errorf("unable to look up thread for delivery %d: %s", delivery.ID, err)
+	}
+	switch {
+	case root != 0 && isCard && thread.Card != "":
+		// deliveries are sent in order, so a newer card queued for the same
+		// item would only overwrite this one
+		newer, err := q.db.HasNewerCard(delivery)
+		if err != nil {
+			q.Errorf("unable to look up newer cards for delivery %d: %s", delivery.ID, err)
+		}
+		if newer {
+			q.Debug("skipping status card of delivery %d, a newer one is queued", delivery.ID)
+			return nil
+		}
+		_, err = q.kbc.EditByConvID(delivery.ConvID, root, thread.Card)
+		if err == nil {
+			return nil
+		}
+		// the card may have been deleted, so post a new one
+		q.Debug("unable to edit status card for delivery %d, posting a new one: %s", delivery.ID, err)
+	case root != 0:
+		_, err := q.kbc.SendReplyByConvID(delivery.ConvID, &root, "%s", delivery.Message)
+		return err
+	}
+
+	message := delivery.Message
+	if thread.Card != "" {
+		message = thread.Card
+	}
+	res, err := q.kbc.SendMessageByConvID(delivery.ConvID, "%s", message)
+	if err != nil {
+		return err
+	}
+	if res.Result.MessageID != nil {
+		if err := q.db.SetThreadMessage(delivery.ConvID, thread, *res.Result.MessageID, thread.Card != ""); err != nil {
+			q.Errorf("unable to remember thread for delivery %d: %s", delivery.ID, err)
+		}
+	}
+	return nil
+}
+
+// syncMessage renders the commits pushed to a pull request into the delivery's
+// message. The queued message, which only links to the changes, is used when
+// they can't be looked up.
+func (q *DeliveryQueue) syncMessage(delivery Delivery) string {
+	api := q.handler.botAPIClient()
+	if api == nil {
+		return delivery.Message
+	}
+	data := delivery.Sync.Data
+	// the pull request's commits are available in the base repo, even when it
+	// comes from a fork
+	commits, ok, err := api.CommitsBetween(data.Repo, delivery.Sync.Base, delivery.Sync.Head, maxSyncCommits)
+	if err != nil {
+		q.Debug("unable to list new commits of %s#%d for delivery %d: %s", data.Repo, data.Index, delivery.ID, err)
+	}
+	if !ok {
+		return delivery.Message
+	}
+	// oldest first, like pushes
+	for i := len(commits) - 1; i >= 0; i-- {
+		if commits[i].RepoCommit != nil {
+			commit := apiCommit(commits[i])
+			commit.ByPusher = authoredBy(commit, delivery.Sync.SenderUsername, data.Sender)
+			data.Commits = append(data.Commits, commit)
+		}
+	}
+	text, err := q.templates.Render(delivery.ConvID, &Message{Template: TemplatePullRequestSync, Data: data})
+	if err != nil || text == "" {
+		q.Debug("unable to render new commits for delivery %d: %v", delivery.ID, err)
+		return delivery.Message
+	}
+	return text
+}
+
+// retryBackoff doubles the wait after every failed attempt, up to queueMaxBackoff.
+func retryBackoff(attempts int) time.Duration {
+	backoff := queueBaseBackoff
+	for i := 1; i < attempts && backoff < queueMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > queueMaxBackoff {
+		backoff = queueMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,487 @@
+package giteabot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// Template names, one per kind of message the bot posts. Conversations and
+// operators can override any of them.
+const (
+	TemplatePush              = "push"
+	TemplateCreate            = "create"
+	TemplateDelete            = "delete"
+	TemplateFork              = "fork"
+	TemplateIssues            = "issues"
+	TemplateIssueComment      = "issue_comment"
+	TemplateRepository        = "repository"
+	TemplateRelease           = "release"
+	TemplatePullRequest       = "pull_request"
+	TemplatePullRequestSync   = "pull_request_sync"
+	TemplatePullRequestReview = "pull_request_review"
+	TemplateWiki              = "wiki"
+	TemplateStatus            = "status"
+	TemplatePackage           = "package"
+	TemplateCard              = "card"
+	TemplateUnknown           = "unknown"
+)
+
+// Style is how much detail a conversation wants in its messages.
+type Style string
+
+const (
+	// StyleCompact keeps every message to a line or two
+	StyleCompact Style = "compact"
+	StyleNormal  Style = "normal"
+	// StyleVerbose includes full comment bodies and commit messages
+	StyleVerbose Style = "verbose"
+)
+
+var Styles = []Style{StyleCompact, StyleNormal, StyleVerbose}
+
+// ParseStyle returns the style named name, or false if there is none.
+func ParseStyle(name string) (Style, bool) {
+	for _, style := range Styles {
+		if string(style) == strings.ToLower(name) {
+			return style, true
+		}
+	}
+	return "", false
+}
+
+// Message is something to post, rendered for each conversation with the
+// template named Template. Data is the template's data, one of the xxxData
+// types below.
+type Message struct {
+	Template string
+	Data     interface{}
+}
+
+// The data model of the templates. Every field is documented for template
+// authors in the README.
+
+// PushData is the data of the "push" template.
+type PushData struct {
+	// Pusher is who pushed, or a comma separated list of everyone who did for
+	// debounced pushes
+	Pusher     string
+	Repo       string
+	Branch     string
+	NumPushes  int
+	NumCommits int
+	Commits    []CommitData
+	// CommitURL links to the head commit
+	CommitURL string
+	// CompareURL links to the changes of the whole push
+	CompareURL string
+	// Before and After are the branch's head commit before and after the push
+	Before string
+	After  string
+}
+
+// CommitData is a commit in PushData and PullRequestSyncData.
+type CommitData struct {
+	SHA     string
+	Message string
+	Author  string
+	URL     string
+	// Username is the author's Gitea account, when the commit's email belongs
+	// to one
+	Username string
+	// ByPusher is set when the author is who pushed the commit, or who pushed
+	// it to the pull request
+	ByPusher bool
+	// Added, Removed and Modified are the files the commit touched, when
+	// Gitea sends them
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// FileStats summarizes the files c touched, e.g. "1 added, 2 modified", or ""
+// if that isn't known.
+func (c CommitData) FileStats() string {
+	var stats []string
+	for _, files := range []struct {
+		verb  string
+		files []string
+	}{{"added", c.Added}, {"modified", c.Modified}, {"removed", c.Removed}} {
+		if len(files.files) > 0 {
+			stats = append(stats, fmt.Sprintf("%d %s", len(files.files), files.verb))
+		}
+	}
+	return strings.Join(stats, ", ")
+}
+
+// RefData is the data of the "create" and "delete" templates.
+type RefData struct {
+	Ref     string
+	RefType string
+	Repo    string
+}
+
+// ForkData is the data of the "fork" template.
+type ForkData struct {
+	Repo string
+	Fork string
+}
+
+// IssueData is the data of the "issues" and "pull_request" templates.
+type IssueData struct {
+	// Kind is "issue" or "PR"
+	Kind     string
+	Action   string
+	Sender   string
+	Repo     string
+	Index    int64
+	Title    string
+	Assignee string
+	// Source is the branch a pull request comes from
+	Source  string
+	URL     string
+	Changes IssueChanges
+}
+
+// IssueCommentData is the data of the "issue_comment" template.
+type IssueCommentData struct {
+	Action string
+	Poster string
+	Repo   string
+	Index  int64
+	Title  string
+	Body   string
+	URL    string
+}
+
+// RepositoryData is the data of the "repository" template. Gitea only sends
+// created and deleted; renamed, transferred, archived, unarchived, publicized
+// and privatized are noticed by comparing other events with what we saw last,
+// so their Sender is empty.
+type RepositoryData struct {
+	Action string
+	Sender string
+	Repo   string
+	// PrevRepo is the name before a rename or transfer
+	PrevRepo string
+	URL      string
+}
+
+// ReleaseData is the data of the "release" template.
+type ReleaseData struct {
+	Action string
+	Sender string
+	Repo   string
+	Title  string
+	Tag    string
+	URL    string
+}
+
+// PullRequestSyncData is the data of the "pull_request_sync" template.
+type PullRequestSyncData struct {
+	Sender string
+	Repo   string
+	Index  int64
+	Title  string
+	// Commits are the new commits, oldest first, if they could be looked up
+	Commits    []CommitData
+	CompareURL string
+	URL        string
+}
+
+// ReviewData is the data of the "pull_request_review" template.
+type ReviewData struct {
+	// Type is the event type, e.g. "pull_request_approved"
+	Type     string
+	Reviewer string
+	Repo     string
+	Index    int64
+	Title    string
+	Review   string
+	// URL links to the pull request's changes, since Gitea doesn't send
+	// anything identifying the review itself
+	URL string
+}
+
+// WikiData is the data of the "wiki" template.
+type WikiData struct {
+	Action  string
+	Sender  string
+	Repo    string
+	Page    string
+	Comment string
+	URL     string
+}
+
+// StatusData is the data of the "status" template.
+type StatusData struct {
+	// Outcome is "success" or "failure"
+	Outcome     string
+	Context     string
+	Description string
+	Repo        string
+	Branches    []string
+	SHA         string
+	URL         string
+}
+
+// PackageData is the data of the "package" template.
+type PackageData struct {
+	Action  string
+	Sender  string
+	Type    string
+	Name    string
+	Version string
+	URL     string
+}
+
+// GenericData is the data of the "unknown" template, used for event types the
+// bot has no dedicated template for.
+type GenericData struct {
+	EventType string
+	// Event is EventType spelled out, e.g. "issue sla"
+	Event  string
+	Action string
+	Sender string
+	Repo   string
+	URL    string
+}
+
+var templateFuncs = template.FuncMap{
+	"esc":  EscapeMarkdown,
+	"code": formatCode,
+	"codes": func(list []string) string {
+		return strings.Join(quoteLabels(list), ", ")
+	},
+	"quote": func(text string) string {
+		return "> " + strings.Replace(strings.TrimSpace(text), "\n", "\n> ", -1)
+	},
+	"excerpt":   formatExcerpt,
+	"strip":     stripBody,
+	"firstline": formatCommitString,
+	"body": func(text string) string {
+		if i := strings.Index(text, "\n"); i >= 0 {
+			return strings.TrimSpace(text[i+1:])
+		}
+		return ""
+	},
+	"join": func(list []string, sep string) string {
+		return strings.Join(list, sep)
+	},
+	"limit": func(commits []CommitData, n int) []CommitData {
+		if len(commits) > n {
+			return commits[:n]
+		}
+		return commits
+	},
+	"minus": func(a int, b int) int {
+		return a - b
+	},
+	"plural": func(n int, word string) string {
+		if n == 1 {
+			return word
+		}
+		return word + "s"
+	},
+	"labels": formatLabels,
+	"short": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}
+
+// verboseBodyLength is how much of a comment verbose messages show, leaving
+// room for the rest of the message within maxMessageLength.
+const verboseBodyLength = 4000
+
+// renderFuncs depend on the style templates are rendered in. They're replaced
+// for each rendering, so the parsed templates can be shared.
+func renderFuncs(style Style, maxBodyLength int) template.FuncMap {
+	if style == StyleVerbose {
+		maxBodyLength = verboseBodyLength
+	}
+	return template.FuncMap{
+		"summary": func(text string, link string) string {
+			return formatSummary(text, link, maxBodyLength)
+		},
+		"style": func() string {
+			return string(style)
+		},
+		"compact": func() bool {
+			return style == StyleCompact
+		},
+		"verbose": func() bool {
+			return style == StyleVerbose
+		},
+	}
+}
+
+// Templates renders messages. The defaults are compiled in and can be
+// overridden by the operator from a directory of <name>.tmpl files, and by each
+// conversation with `!gitea template`.
+type Templates struct {
+	db            *DB
+	maxBodyLength int
+	// base holds the helper templates every template can use
+	base     *template.Template
+	texts    map[string]string
+	defaults map[string]*template.Template
+}
+
+// NewTemplates loads the default templates, overridden by any found in dir.
+// Comments are cut to maxBodyLength characters in the normal style.
+func NewTemplates(db *DB, dir string, maxBodyLength int) (*Templates, error) {
+	base, err := template.New("").Funcs(templateFuncs).Funcs(renderFuncs(StyleNormal, maxBodyLength)).Parse(helperTemplates)
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{
+		db:            db,
+		maxBodyLength: maxBodyLength,
+		base:          base,
+		texts:         make(map[string]string),
+		defaults:      make(map[string]*template.Template),
+	}
+	for name, text := range defaultTemplates {
+		t.texts[name] = text
+	}
+	if dir != "" {
+		if err := t.loadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	for name, text := range t.texts {
+		tmpl, err := t.parse(name, text)
+		if err != nil {
+			return nil, err
+		}
+		t.defaults[name] = tmpl
+	}
+	return t, nil
+}
+
+func (t *Templates) loadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if _, ok := t.texts[name]; !ok {
+			return fmt.Errorf("unknown template %q in %s", name, file)
+		}
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		t.texts[name] = string(text)
+	}
+	return nil
+}
+
+func (t *Templates) parse(name string, text string) (*template.Template, error) {
+	tmpl, err := t.base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.New(name).Parse(text)
+}
+
+// Names returns the names of all templates, sorted.
+func (t *Templates) Names() (res []string) {
+	for name := range t.texts {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Exists reports whether name is a known template.
+func (t *Templates) Exists(name string) bool {
+	_, ok := t.texts[name]
+	return ok
+}
+
+// Text returns the template text used when a conversation hasn't set its own.
+func (t *Templates) Text(name string) string {
+	return t.texts[name]
+}
+
+// Validate checks that text parses as a template.
+func (t *Templates) Validate(name string, text string) error {
+	_, err := t.parse(name, text)
+	return err
+}
+
+// RenderDefault renders msg with the default template in the normal style. A
+// message that renders to nothing shouldn't be posted.
+func (t *Templates) RenderDefault(msg *Message) (string, error) {
+	return t.renderDefault(msg, StyleNormal)
+}
+
+func (t *Templates) renderDefault(msg *Message, style Style) (string, error) {
+	tmpl, ok := t.defaults[msg.Template]
+	if !ok {
+		return "", fmt.Errorf("unknown template %q", msg.Template)
+	}
+	return t.execute(tmpl, style, msg.Data)
+}
+
+// Render renders msg for convID in the conversation's style, with its own
+// template if it has set one. If that can't be used, the default template is
+// used instead, and the returned error says why alongside the default
+// rendering.
+func (t *Templates) Render(convID chat1.ConvIDStr, msg *Message) (string, error) {
+	style, styleErr := t.db.GetConvStyle(convID)
+	if styleErr != nil {
+		style = StyleNormal
+	}
+	res, err := t.render(convID, msg, style)
+	if err == nil && styleErr != nil {
+		err = fmt.Errorf("using the %s style: %s", StyleNormal, styleErr)
+	}
+	return res, err
+}
+
+func (t *Templates) render(convID chat1.ConvIDStr, msg *Message, style Style) (string, error) {
+	text, err := t.db.GetConvTemplate(convID, msg.Template)
+	if err == nil && text == "" {
+		return t.renderDefault(msg, style)
+	}
+	if err == nil {
+		var tmpl *template.Template
+		if tmpl, err = t.parse(msg.Template, text); err == nil {
+			var res string
+			if res, err = t.execute(tmpl, style, msg.Data); err == nil {
+				return res, nil
+			}
+		}
+	}
+	res, defaultErr := t.renderDefault(msg, style)
+	if defaultErr != nil {
+		return "", defaultErr
+	}
+	return res, fmt.Errorf("using the default %q template: %s", msg.Template, err)
+}
+
+func (t *Templates) execute(tmpl *template.Template, style Style, data interface{}) (string, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Funcs(renderFuncs(style, t.maxBodyLength)).Execute(&buf, data); err != nil {
+		return "", err
+	}
+	// conversations' own templates may not escape what they show, but should
+	// never ping anyone either way
+	return capMessage(NeutralizeMentions(strings.TrimSpace(buf.String()))), nil
+}
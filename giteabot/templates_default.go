@@ -0,0 +1,235 @@
+package giteabot
+
+// helperTemplates are available to every template, including the ones set by
+// conversations.
+const helperTemplates = `
+{{- define "commit"}}
+	{{- with .SHA}}{{code (short .)}} {{end}}
+	{{- if verbose}}{{esc (firstline .Message 200)}}{{else}}{{esc (firstline .Message 72)}}{{end}}
+{{- end}}
+
+{{- define "commit_body"}}
+	{{- if verbose}}{{with body .Message}}
+{{quote (esc .)}}{{end}}{{end}}
+{{- end}}
+
+{{- define "item"}}{{.Kind}} "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}{{end}}
+
+{{- define "changes"}}
+{{- if or (eq .Action "label_updated") (eq .Action "label_cleared")}}
+	{{- if or .Changes.AddedLabels .Changes.RemovedLabels}}
+		{{- esc .Sender}} {{if .Changes.AddedLabels}}added {{labels .Changes.AddedLabels}}{{end}}
+		{{- if and .Changes.AddedLabels .Changes.RemovedLabels}} and {{end}}
+		{{- if .Changes.RemovedLabels}}removed {{labels .Changes.RemovedLabels}}{{end}} on {{template "item" .}}: {{.URL}}
+	{{- else if eq .Action "label_cleared"}}
+		{{- esc .Sender}} removed all labels from {{template "item" .}}: {{.URL}}
+	{{- else}}
+		{{- esc .Sender}} changed the labels on {{template "item" .}}: {{.URL}}
+	{{- end}}
+{{- else if eq .Action "milestoned"}}
+	{{- esc .Sender}} added {{template "item" .}} to milestone "{{esc .Changes.Milestone}}": {{.URL}}
+{{- else if eq .Action "demilestoned"}}
+	{{- if .Changes.Milestone}}
+		{{- esc .Sender}} removed {{template "item" .}} from milestone "{{esc .Changes.Milestone}}": {{.URL}}
+	{{- else}}
+		{{- esc .Sender}} removed {{template "item" .}} from its milestone: {{.URL}}
+	{{- end}}
+{{- else if eq .Action "unassigned"}}
+	{{- if .Changes.Unassigned}}
+		{{- esc .Sender}} unassigned {{esc (join .Changes.Unassigned ", ")}} from {{template "item" .}}: {{.URL}}
+	{{- else}}
+		{{- esc .Sender}} unassigned {{template "item" .}}: {{.URL}}
+	{{- end}}
+{{- else}}
+	{{- esc .Sender}} {{.Action}} {{.Kind}} #{{.Index}}
+{{- end}}
+{{- end}}
+`
+
+var defaultTemplates = map[string]string{
+	TemplatePush: `
+{{- esc .Pusher}} pushed {{.NumCommits}} {{plural .NumCommits "commit"}}
+{{- if gt .NumPushes 1}} in {{.NumPushes}} pushes{{end}} to {{esc .Repo}} {{esc .Branch}}:
+{{- if compact}} {{or .CompareURL .CommitURL}}
+{{- else}}
+{{- $shown := limit .Commits 10}}
+{{- range $shown}}
+- {{template "commit" .}}{{if not .ByPusher}}{{with .Author}} by {{esc .}}{{end}}{{end}}
+	{{- if verbose}}{{with .FileStats}} ({{.}}){{end}}{{end}}{{with .URL}}: {{.}}{{end}}{{template "commit_body" .}}
+{{- end}}
+{{- with minus .NumCommits (len $shown)}}{{if gt . 0}}
+...and {{.}} more {{plural . "commit"}}{{end}}{{end}}
+{{- with .CompareURL}}
+
+Changes: {{.}}
+{{- else}}{{if not $shown}}
+
+{{if gt .NumPushes 1}}Head: {{end}}{{.CommitURL}}{{end}}
+{{- end}}
+{{- end}}
+`,
+
+	TemplateCreate: `Created new {{.RefType}} {{esc .Ref}} in repo {{esc .Repo}}`,
+
+	TemplateDelete: `Deleted {{.RefType}} {{esc .Ref}} in repo {{esc .Repo}}`,
+
+	TemplateFork: `{{esc .Repo}} has been forked to {{esc .Fork}}`,
+
+	TemplateIssues: `
+{{- if or (eq .Action "opened") (eq .Action "closed") (eq .Action "reopened") (eq .Action "edited")}}
+	{{- esc .Sender}} {{.Action}} {{template "item" .}}: {{.URL}}
+{{- else if eq .Action "assigned"}}
+	{{- esc .Sender}} {{.Action}} {{template "item" .}} to {{esc .Assignee}}: {{.URL}}
+{{- else}}
+	{{- template "changes" .}}
+{{- end}}
+`,
+
+	TemplatePullRequest: `
+{{- if or (eq .Action "opened") (eq .Action "closed") (eq .Action "reopened") (eq .Action "edited")}}
+	{{- esc .Sender}} {{.Action}} {{template "item" .}} from source {{esc .Source}}: {{.URL}}
+{{- else if eq .Action "assigned"}}
+	{{- esc .Sender}} {{.Action}} {{template "item" .}} to {{esc .Assignee}}: {{.URL}}
+{{- else}}
+	{{- template "changes" .}}
+{{- end}}
+`,
+
+	TemplateIssueComment: `
+{{- if compact}}
+	{{- if eq .Action "created"}}
+		{{- esc .Poster}} commented on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}: {{.URL}}
+	{{- else if eq .Action "deleted"}}
+		{{- esc .Poster}} deleted their comment on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}
+	{{- else if eq .Action "edited"}}
+		{{- esc .Poster}} edited their comment on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}: {{.URL}}
+	{{- end}}
+{{- else if eq .Action "created"}}
+	{{- esc .Poster}} commented on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}:
+{{summary .Body .URL}}
+{{- else if eq .Action "deleted"}}
+	{{- esc .Poster}} deleted their comment on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}:
+{{summary .Body ""}}
+{{- else if eq .Action "edited"}}
+	{{- esc .Poster}} edited their comment on issue "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}:
+{{summary .Body .URL}}
+{{- end}}
+`,
+
+	TemplateRepository: `
+{{- if or (eq .Action "created") (eq .Action "deleted")}}
+	{{- esc .Sender}} {{.Action}} repository {{esc .Repo}}
+{{- else if or (eq .Action "renamed") (eq .Action "transferred")}}
+	{{- esc .PrevRepo}} was {{.Action}} to {{esc .Repo}}, and this conversation follows it there: {{.URL}}
+{{- else if or (eq .Action "archived") (eq .Action "unarchived")}}
+	{{- esc .Repo}} was {{.Action}}: {{.URL}}
+{{- else if eq .Action "publicized"}}
+	{{- esc .Repo}} was made public: {{.URL}}
+{{- else if eq .Action "privatized"}}
+	{{- esc .Repo}} was made private: {{.URL}}
+{{- end}}
+`,
+
+	TemplateRelease: `
+{{- if or (eq .Action "published") (eq .Action "updated")}}
+	{{- esc .Sender}} {{.Action}} release "{{esc .Title}}" ({{esc .Tag}}) in {{esc .Repo}}: {{.URL}}
+{{- else if eq .Action "deleted"}}
+	{{- esc .Sender}} {{.Action}} release "{{esc .Title}}" ({{esc .Tag}}) in {{esc .Repo}}
+{{- end}}
+`,
+
+	TemplatePullRequestSync: `
+{{- if compact}}
+	{{- esc .Sender}} pushed {{with .Commits}}{{len .}} {{plural (len .) "commit"}}{{else}}new commits{{end}} to PR "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}: {{or .CompareURL .URL}}
+{{- else if .Commits}}
+	{{- esc .Sender}} pushed {{len .Commits}} {{plural (len .Commits) "commit"}} to PR "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}:
+{{- $shown := limit .Commits 10}}
+{{- range $shown}}
+- {{template "commit" .}}{{if not .ByPusher}}{{with .Author}} by {{esc .}}{{end}}{{end}}
+	{{- if verbose}}{{with .FileStats}} ({{.}}){{end}}{{end}}{{with .URL}}: {{.}}{{end}}{{template "commit_body" .}}
+{{- end}}
+{{- with minus (len .Commits) (len $shown)}}{{if gt . 0}}
+...and {{.}} more {{plural . "commit"}}{{end}}{{end}}
+
+{{.URL}}
+{{- else}}
+	{{- esc .Sender}} pushed new commits to PR "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}: {{.URL}}
+{{- end}}
+{{- if not compact}}{{with .CompareURL}}
+Changes: {{.}}{{end}}{{end}}
+`,
+
+	TemplatePullRequestReview: `
+{{- if eq .Type "pull_request_approved"}}
+	{{- esc .Reviewer}} approved
+{{- else if eq .Type "pull_request_rejected"}}
+	{{- esc .Reviewer}} requested changes on
+{{- else}}
+	{{- esc .Reviewer}} reviewed
+{{- end}} PR "{{esc .Title}}" (#{{.Index}}) on {{esc .Repo}}: {{.URL}}
+{{- if verbose}}{{with strip .Review}}
+{{quote (esc .)}}{{end}}
+{{- else if not compact}}{{with excerpt (strip .Review) 280}}
+{{quote (esc .)}}{{end}}
+{{- end}}
+`,
+
+	TemplateWiki: `
+{{- if or (eq .Action "created") (eq .Action "edited") (eq .Action "renamed")}}
+	{{- esc .Sender}} {{.Action}} wiki page "{{esc .Page}}" in {{esc .Repo}}: {{.URL}}
+{{- else if eq .Action "deleted"}}
+	{{- esc .Sender}} {{.Action}} wiki page "{{esc .Page}}" in {{esc .Repo}}
+{{- end}}
+{{- if or (eq .Action "created") (eq .Action "edited") (eq .Action "renamed") (eq .Action "deleted")}}
+	{{- if verbose}}{{with .Comment}}
+{{quote (esc .)}}{{end}}
+	{{- else if not compact}}{{with excerpt .Comment 280}}
+{{quote (esc .)}}{{end}}
+	{{- end}}
+{{- end}}
+`,
+
+	TemplateStatus: `
+{{- if eq .Outcome "failure"}}
+	{{- code .Context}} is failing on {{esc (join .Branches ", ")}} ({{short .SHA}}) in {{esc .Repo}}
+{{- else if eq .Outcome "success"}}
+	{{- code .Context}} is passing again on {{esc (join .Branches ", ")}} ({{short .SHA}}) in {{esc .Repo}}
+{{- end}}
+{{- if and .Outcome compact}}
+	{{- with .URL}}: {{.}}{{end}}
+{{- else if .Outcome}}
+	{{- with .Description}}: {{esc .}}{{end}}
+	{{- with .URL}}
+{{.}}{{end}}
+{{- end}}
+`,
+
+	TemplatePackage: `
+{{- if eq .Action "created"}}
+	{{- esc .Sender}} published {{esc .Type}} package {{esc .Name}} {{esc .Version}}: {{.URL}}
+{{- else if eq .Action "deleted"}}
+	{{- esc .Sender}} deleted {{esc .Type}} package {{esc .Name}} {{esc .Version}}
+{{- end}}
+`,
+
+	TemplateCard: `
+{{- .Kind}} #{{.Index}} on {{esc .Repo}}: "{{esc .Title}}" (*{{.State}}*)
+{{- if compact}}: {{.URL}}
+{{- else}}
+{{- $sep := ""}}
+{{- if or .Author .Assignees .Labels .Milestone}}
+{{end}}
+{{- with .Author}}{{$sep}}Opened by {{esc .}}{{with $.Source}} from {{esc .}}{{end}}{{$sep = " · "}}{{end}}
+{{- with .Assignees}}{{$sep}}Assigned to {{esc (join . ", ")}}{{$sep = " · "}}{{end}}
+{{- with .Labels}}{{$sep}}Labels: {{codes .}}{{$sep = " · "}}{{end}}
+{{- with .Milestone}}{{$sep}}Milestone: {{esc .}}{{end}}
+{{.URL}}
+{{- end}}
+`,
+
+	TemplateUnknown: `
+{{- esc .Event}}{{with .Action}} {{esc .}}{{end}} event in {{esc .Repo}}
+{{- with .Sender}} (by {{esc .}}){{end}}
+{{- with .URL}}: {{.}}{{end}}
+`,
+}
@@ -1,10 +1,19 @@
 package giteabot
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	gitea "code.gitea.io/gitea/modules/structs"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -32,15 +41,340 @@ const (
 	EventTypePullRequestApproved EventType = "pull_request_approved"
 	EventTypePullRequestRejected EventType = "pull_request_rejected"
 	EventTypePullRequestComment  EventType = "pull_request_comment"
+	EventTypeWiki                EventType = "wiki"
+	EventTypeStatus              EventType = "status"
+	EventTypePackage             EventType = "package"
 )
 
-const eventTypeHeader = "X-Gitea-Event"
+// SubscribableEventTypes lists the events a subscription can be limited to.
+var SubscribableEventTypes = []EventType{
+	EventTypeCreate,
+	EventTypeDelete,
+	EventTypeFork,
+	EventTypePush,
+	EventTypeIssues,
+	EventTypeIssueComment,
+	EventTypeRepository,
+	EventTypeRelease,
+	EventTypePullRequest,
+	EventTypePullRequestApproved,
+	EventTypePullRequestRejected,
+	EventTypePullRequestComment,
+	EventTypeWiki,
+	EventTypeStatus,
+	EventTypePackage,
+}
+
+// ParseEventTypes parses a comma separated list of event types, as given to
+// `!gitea subscribe --events`. "all" yields nil, meaning every event.
+func ParseEventTypes(list string) ([]EventType, error) {
+	if strings.TrimSpace(list) == "all" {
+		return nil, nil
+	}
+	var res []EventType
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		eventType, ok := findEventType(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event %q", name)
+		}
+		res = append(res, eventType)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no events given")
+	}
+	return res, nil
+}
+
+func findEventType(name string) (EventType, bool) {
+	for _, eventType := range SubscribableEventTypes {
+		if string(eventType) == name {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+// Serialize event types for the events column of the subscriptions table
+func joinEventTypes(events []EventType) string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, string(event))
+	}
+	return strings.Join(names, ",")
+}
+
+func splitEventTypes(events string) (res []EventType) {
+	for _, name := range strings.Split(events, ",") {
+		if name != "" {
+			res = append(res, EventType(name))
+		}
+	}
+	return res
+}
+
+// BranchFilter is a list of branch globs like "main" or "release/*". Globs
+// starting with "!" exclude branches. A branch matches when no exclude glob
+// matches it and, if there are any include globs, at least one of them does.
+type BranchFilter []string
+
+// ParseBranchFilter parses a comma separated list of branch globs, as given to
+// `!gitea subscribe --branches`. "all" yields an empty filter.
+func ParseBranchFilter(list string) (BranchFilter, error) {
+	if strings.TrimSpace(list) == "all" {
+		return nil, nil
+	}
+	var res BranchFilter
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || pattern == "!" {
+			continue
+		}
+		if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		res = append(res, pattern)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no branches given")
+	}
+	return res, nil
+}
+
+func splitBranchFilter(branches string) (res BranchFilter) {
+	for _, pattern := range strings.Split(branches, ",") {
+		if pattern != "" {
+			res = append(res, pattern)
+		}
+	}
+	return res
+}
+
+// String serializes the filter for the branches column of the subscriptions table
+func (f BranchFilter) String() string {
+	return strings.Join(f, ",")
+}
+
+// Matches reports whether branch passes the filter.
+func (f BranchFilter) Matches(branch string) bool {
+	included, hasIncludes := false, false
+	for _, pattern := range f {
+		if strings.HasPrefix(pattern, "!") {
+			if ok, _ := path.Match(pattern[1:], branch); ok {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		if ok, _ := path.Match(pattern, branch); ok {
+			included = true
+		}
+	}
+	return included || !hasIncludes
+}
+
+// ValidateRepo checks that repo looks like "owner/repo". The repo part may also
+// be a pattern like "*" or "prefix-*", subscribing to every matching repository
+// of the owner, including ones created later. "*" is the only wildcard, since
+// pattern subscriptions are looked up by it.
+func ValidateRepo(repo string) error {
+	parsedRepo := strings.Split(repo, "/")
+	if len(parsedRepo) != 2 || parsedRepo[0] == "" || parsedRepo[1] == "" {
+		return fmt.Errorf("missing owner or repo")
+	}
+	if IsRepoPattern(parsedRepo[0]) {
+		return fmt.Errorf("the owner can't be a pattern")
+	}
+	if strings.ContainsAny(parsedRepo[1], `?[]\`) {
+		return fmt.Errorf("only * is supported in patterns")
+	}
+	return nil
+}
+
+// IsRepoPattern reports whether repo is a pattern rather than a single
+// repository.
+func IsRepoPattern(repo string) bool {
+	return strings.Contains(repo, "*")
+}
+
+// repoOwner returns the owner of an "owner/repo" name or pattern.
+func repoOwner(repo string) string {
+	return strings.SplitN(repo, "/", 2)[0]
+}
+
+// RepoMatches reports whether the repository fullName is covered by the
+// subscribed repo, which is either the same name or a glob. Names are compared
+// case insensitively.
+func RepoMatches(repo string, fullName string) bool {
+	repo, fullName = strings.ToLower(repo), strings.ToLower(fullName)
+	if !IsRepoPattern(repo) {
+		return repo == fullName
+	}
+	ok, _ := path.Match(repo, fullName)
+	return ok
+}
+
+// LabelFilter is a list of label names. When set, label changes are only
+// posted if they apply one of these labels.
+type LabelFilter []string
+
+// ParseLabelFilter parses a comma separated list of labels, as given to
+// `!gitea subscribe --labels`. "all" yields an empty filter.
+func ParseLabelFilter(list string) (LabelFilter, error) {
+	if strings.TrimSpace(list) == "all" {
+		return nil, nil
+	}
+	res := splitLabelFilter(list)
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no labels given")
+	}
+	return res, nil
+}
+
+func splitLabelFilter(labels string) (res LabelFilter) {
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			res = append(res, label)
+		}
+	}
+	return res
+}
+
+// String serializes the filter for the labels column of the subscriptions table
+func (f LabelFilter) String() string {
+	return strings.Join(f, ",")
+}
+
+// Matches reports whether a label change adding the labels in added passes
+// the filter. Label names are compared case insensitively.
+func (f LabelFilter) Matches(added []string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, label := range added {
+		for _, want := range f {
+			if strings.EqualFold(label, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IssueChanges describes what a label, milestone or assignee action changed
+// on an issue or pull request.
+type IssueChanges struct {
+	AddedLabels   []string
+	RemovedLabels []string
+	// Milestone is the milestone the item was added to or removed from
+	Milestone  string
+	Unassigned []string
+}
+
+// diffIssueState works out what changed between the last state we saw of an
+// issue, which may be unknown, and its current state.
+func diffIssueState(prev *IssueState, cur IssueState) (changes IssueChanges) {
+	changes.Milestone = cur.Milestone
+	if prev == nil {
+		changes.AddedLabels = cur.Labels
+		return changes
+	}
+	changes.AddedLabels = subtractStrings(cur.Labels, prev.Labels)
+	changes.RemovedLabels = subtractStrings(prev.Labels, cur.Labels)
+	if changes.Milestone == "" {
+		changes.Milestone = prev.Milestone
+	}
+	changes.Unassigned = subtractStrings(prev.Assignees, cur.Assignees)
+	return changes
+}
+
+// subtractStrings returns the elements of a that are not in b.
+func subtractStrings(a []string, b []string) (res []string) {
+	for _, s := range a {
+		found := false
+		for _, t := range b {
+			if s == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func labelNames(labels []*gitea.Label) (res []string) {
+	for _, label := range labels {
+		res = append(res, label.Name)
+	}
+	return res
+}
+
+// userName returns the display name of user, falling back to their username.
+func userName(user *gitea.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.FullName != "" {
+		return user.FullName
+	}
+	return user.UserName
+}
+
+func userNames(users []*gitea.User) (res []string) {
+	for _, user := range users {
+		res = append(res, user.UserName)
+	}
+	return res
+}
+
+func milestoneTitle(milestone *gitea.Milestone) string {
+	if milestone == nil {
+		return ""
+	}
+	return milestone.Title
+}
+
+const (
+	eventTypeHeader = "X-Gitea-Event"
+	signatureHeader = "X-Gitea-Signature"
+	deliveryHeader  = "X-Gitea-Delivery"
+)
 
 // WebhookEventType returns the event type for the given request.
 func WebhookEventType(r *http.Request) EventType {
 	return EventType(r.Header.Get(eventTypeHeader))
 }
 
+// WebhookSignature returns the hex encoded HMAC-SHA256 signature Gitea computed
+// over the request body, or an empty string if the request is unsigned.
+func WebhookSignature(r *http.Request) string {
+	return r.Header.Get(signatureHeader)
+}
+
+// WebhookDeliveryID returns the GUID Gitea assigned to this delivery. Gitea
+// reuses it when a delivery is retried or redelivered by hand.
+func WebhookDeliveryID(r *http.Request) string {
+	return r.Header.Get(deliveryHeader)
+}
+
+// ValidSignature reports whether signature is the HMAC-SHA256 of payload keyed
+// with secret. The comparison runs in constant time.
+func ValidSignature(signature string, payload []byte, secret string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
 // ParseWebhook parses the event payload. For recognized event types, a
 // value of the corresponding struct type will be returned. An error will
 // be returned for unrecognized event types.
@@ -66,7 +400,7 @@ func WebhookEventType(r *http.Request) EventType {
 func ParseWebhook(eventType EventType, payload []byte) (event interface{}, err error) {
 	switch eventType {
 	case EventTypePush:
-		event = &gitea.PushPayload{}
+		event = &PushPayload{}
 	case EventTypeCreate:
 		event = &gitea.CreatePayload{}
 	case EventTypeDelete:
@@ -81,10 +415,18 @@ func ParseWebhook(eventType EventType, payload []byte) (event interface{}, err e
 		event = &gitea.RepositoryPayload{}
 	case EventTypeRelease:
 		event = &gitea.ReleasePayload{}
-	case EventTypePullRequest, EventTypePullRequestApproved, EventTypePullRequestRejected, EventTypePullRequestComment:
+	case EventTypePullRequest:
 		event = &gitea.PullRequestPayload{}
+	case EventTypePullRequestApproved, EventTypePullRequestRejected, EventTypePullRequestComment:
+		event = &PullRequestReviewPayload{}
+	case EventTypeWiki:
+		event = &WikiPayload{}
+	case EventTypeStatus:
+		event = &CommitStatusPayload{}
+	case EventTypePackage:
+		event = &PackagePayload{}
 	default:
-		return nil, fmt.Errorf("unexpected event type: %s", eventType)
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEventType, eventType)
 	}
 
 	if err := json.Unmarshal(payload, event); err != nil {
@@ -94,13 +436,230 @@ func ParseWebhook(eventType EventType, payload []byte) (event interface{}, err e
 	return event,nil
 }
 
-// Return a list of all commit messages from an event
-func getCommitMessages(event *gitea.PushPayload) []string {
-	var commitMsgs = make([]string, 0)
+// ErrUnknownEventType is returned by ParseWebhook for event types it has no
+// payload for.
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// GenericPayload holds the fields most Gitea webhook payloads share. It's
+// used to describe events we don't otherwise know about.
+type GenericPayload struct {
+	Secret     string            `json:"secret"`
+	Action     string            `json:"action"`
+	Repository *gitea.Repository `json:"repository"`
+	Sender     *gitea.User       `json:"sender"`
+}
+
+// ParseGenericWebhook parses the common fields of any webhook payload.
+func ParseGenericWebhook(payload []byte) (*GenericPayload, error) {
+	var event GenericPayload
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// PushPayload is a gitea.PushPayload with the number of commits pushed. Gitea
+// only sends the last few commits (5 by default, its FEED_MAX_COMMIT_NUM), and
+// the version of its structs we build against doesn't have the total.
+type PushPayload struct {
+	gitea.PushPayload
+	TotalCommits int `json:"total_commits"`
+}
+
+// NumCommits returns how many commits were pushed, which may be more than
+// are in the payload.
+func (p *PushPayload) NumCommits() int {
+	if p.TotalCommits > len(p.Commits) {
+		return p.TotalCommits
+	}
+	return len(p.Commits)
+}
+
+// PullRequestReviewPayload is sent for pull request reviews. It's a
+// PullRequestPayload with the review attached, which the version of Gitea's
+// structs we build against doesn't know about yet.
+type PullRequestReviewPayload struct {
+	gitea.PullRequestPayload
+	Review *ReviewPayload `json:"review"`
+}
+
+// ReviewPayload is the review in a PullRequestReviewPayload
+type ReviewPayload struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+// WikiAction is the action of a WikiPayload
+type WikiAction string
+
+const (
+	WikiActionCreated WikiAction = "created"
+	WikiActionEdited  WikiAction = "edited"
+	WikiActionDeleted WikiAction = "deleted"
+	WikiActionRenamed WikiAction = "renamed"
+)
+
+// WikiPayload is sent when a wiki page changes. Gitea added wiki webhooks
+// after the version of its structs we build against.
+type WikiPayload struct {
+	Secret     string            `json:"secret"`
+	Action     WikiAction        `json:"action"`
+	Repository *gitea.Repository `json:"repository"`
+	Sender     *gitea.User       `json:"sender"`
+	Page       string            `json:"page"`
+	Comment    string            `json:"comment"`
+}
+
+// wikiPageURL returns the link to a wiki page, which Gitea builds from the
+// page name with spaces turned into dashes.
+func wikiPageURL(repoURL string, page string) string {
+	return fmt.Sprintf("%s/wiki/%s", repoURL, url.PathEscape(strings.Replace(page, " ", "-", -1)))
+}
+
+// PackageAction is the action of a PackagePayload
+type PackageAction string
+
+const (
+	PackageActionCreated PackageAction = "created"
+	PackageActionDeleted PackageAction = "deleted"
+)
+
+// PackagePayload is sent when a package is published to or deleted from
+// Gitea's package registry. Gitea added the registry after the version of its
+// structs we build against.
+type PackagePayload struct {
+	Secret  string        `json:"secret"`
+	Action  PackageAction `json:"action"`
+	Package *Package      `json:"package"`
+	Sender  *gitea.User   `json:"sender"`
+}
+
+// Package is the package in a PackagePayload. Repository is only set when the
+// package is linked to a repository.
+type Package struct {
+	Owner      *gitea.User       `json:"owner"`
+	Repository *gitea.Repository `json:"repository"`
+	Creator    *gitea.User       `json:"creator"`
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Version    string            `json:"version"`
+	HTMLURL    string            `json:"html_url"`
+}
+
+// SubscriptionRepo returns the repo a package event is announced for. Packages
+// that aren't linked to a repository belong to their owner, so only
+// subscriptions to all of the owner's repositories get those.
+func (p *Package) SubscriptionRepo() string {
+	if p == nil {
+		return ""
+	}
+	if p.Repository != nil {
+		return p.Repository.FullName
+	}
+	if p.Owner == nil {
+		return ""
+	}
+	return p.Owner.UserName + "/*"
+}
+
+// CommitStatusPayload is sent when a CI system reports the status of a
+// commit. Gitea added status webhooks after the version of its structs we
+// build against.
+type CommitStatusPayload struct {
+	Secret      string            `json:"secret"`
+	SHA         string            `json:"sha"`
+	State       gitea.StatusState `json:"state"`
+	Context     string            `json:"context"`
+	Description string            `json:"description"`
+	TargetURL   string            `json:"target_url"`
+	Repository  *gitea.Repository `json:"repository"`
+	Sender      *gitea.User       `json:"sender"`
+}
+
+// StatusOutcome is whether a commit status is green or red. Pending and
+// warning statuses don't have an outcome.
+type StatusOutcome string
+
+const (
+	StatusOutcomeNone    StatusOutcome = ""
+	StatusOutcomeSuccess StatusOutcome = "success"
+	StatusOutcomeFailure StatusOutcome = "failure"
+)
+
+func statusOutcome(state gitea.StatusState) StatusOutcome {
+	switch state {
+	case gitea.StatusSuccess:
+		return StatusOutcomeSuccess
+	case gitea.StatusFailure, gitea.StatusError:
+		return StatusOutcomeFailure
+	default:
+		return StatusOutcomeNone
+	}
+}
+
+// statusChangeWorthPosting reports whether going from the outcome prev to cur
+// should be posted. The first outcome we see for a context is only posted if
+// it's a failure.
+func statusChangeWorthPosting(prev StatusOutcome, cur StatusOutcome) bool {
+	if prev == cur || cur == StatusOutcomeNone {
+		return false
+	}
+	return prev != StatusOutcomeNone || cur == StatusOutcomeFailure
+}
+
+// Return a list of all commits from an event
+func getCommits(event *PushPayload) []CommitData {
+	var commits = make([]CommitData, 0)
 	for _, commit := range event.Commits {
-		commitMsgs = append(commitMsgs, commit.Message)
+		var author, username string
+		if commit.Author != nil {
+			author = commit.Author.Name
+			username = commit.Author.UserName
+		}
+		data := CommitData{
+			SHA:      commit.ID,
+			Message:  commit.Message,
+			Author:   author,
+			Username: username,
+			URL:      commit.URL,
+			Added:    commit.Added,
+			Removed:  commit.Removed,
+			Modified: commit.Modified,
+		}
+		if event.Pusher != nil {
+			data.ByPusher = authoredBy(data, event.Pusher.UserName, userName(event.Pusher))
+		}
+		commits = append(commits, data)
 	}
-	return commitMsgs
+	return commits
+}
+
+// apiCommit converts a commit returned by the Gitea API.
+func apiCommit(commit *gitea.Commit) CommitData {
+	res := CommitData{URL: commit.HTMLURL}
+	if commit.CommitMeta != nil {
+		res.SHA = commit.SHA
+	}
+	if commit.RepoCommit != nil {
+		res.Message = commit.RepoCommit.Message
+		if commit.RepoCommit.Author != nil {
+			res.Author = commit.RepoCommit.Author.Name
+		}
+	}
+	if commit.Author != nil {
+		res.Username = commit.Author.UserName
+	}
+	return res
+}
+
+// authoredBy reports whether commit was written by the Gitea user with the
+// given username and display name. Accounts are compared when Gitea knows the
+// author's, and names otherwise, since git names needn't match Gitea's.
+func authoredBy(commit CommitData, username string, name string) bool {
+	if commit.Username != "" {
+		return strings.EqualFold(commit.Username, username)
+	}
+	return commit.Author == name || commit.Author == username
 }
 
 // Convert a ref like "refs/head/master" to a branch like "master"
@@ -112,20 +671,56 @@ func refToBranch(ref string) string {
 }
 
 // Formatters
+func formatSubscriptionFilters(subscription Subscription) string {
+	res := formatEventTypes(subscription.Events)
+	if len(subscription.Branches) > 0 {
+		res += fmt.Sprintf(" on branches %s", strings.Join(subscription.Branches, ", "))
+	}
+	if len(subscription.Labels) > 0 {
+		res += fmt.Sprintf(", label changes only for %s", strings.Join(subscription.Labels, ", "))
+	}
+	return res
+}
+
+func formatEventTypes(events []EventType) string {
+	if len(events) == 0 {
+		return "all events"
+	}
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, string(event))
+	}
+	return strings.Join(names, ", ")
+}
+
 func formatSetupInstructions(giteaURL string, repo string, msg chat1.MsgSummary, httpAddress string, secret string) (res string) {
 	back := "`"
+	settings := fmt.Sprintf("To configure your project to send notifications, go to %s/%s/settings/hooks and add a new Gitea webhook.", giteaURL, repo)
+	if IsRepoPattern(repo) {
+		settings = fmt.Sprintf("To configure your organization to send notifications for %s%s%s, go to %s/org/%s/settings/hooks and add a new Gitea webhook. "+
+			"It covers every repository in the organization, including ones created later.", back, repo, back, giteaURL, repoOwner(repo))
+	}
 	message := fmt.Sprintf(`
-To configure your project to send notifications, go to %s/%s/settings/hooks and add a new Gitea webhook.
-For “Target URL”, enter %s%s/giteabot/webhook%s.
+%s
+For “Target URL”, enter %s%s%s.
 "HTTP Method" is POST and the "Content Type" is application/json.
 For “Secret”, enter %s%s%s.
 Remember to check all the triggers you would like me to update you on.
 
 Happy coding!`,
-		giteaURL, repo, back, httpAddress, back, back, base.MakeSecret(repo, msg.ConvID, secret), back)
+		settings, back, webhookURL(httpAddress), back, back, base.MakeSecret(repo, msg.ConvID, secret), back)
 	return message
 }
 
+// webhookURL returns where Gitea should send webhooks, given the bot's
+// --http-prefix. A bare host:port is taken to be plain HTTP.
+func webhookURL(httpPrefix string) string {
+	if !strings.Contains(httpPrefix, "://") {
+		httpPrefix = "http://" + httpPrefix
+	}
+	return strings.TrimSuffix(httpPrefix, "/") + "/giteabot/webhook"
+}
+
 func formatCommitString(commit string, maxLen int) string {
 	firstLine := strings.Split(commit, "\n")[0]
 	if len(firstLine) > maxLen {
@@ -134,91 +729,164 @@ func formatCommitString(commit string, maxLen int) string {
 	return firstLine
 }
 
-// Borrowed from https://github.com/keybase/managed-bots/blob/master/base/git/git.go (3dbf0f6)
-func FormatPushMsg(username string, repo string, branch string, numCommits int, messages []string, commitURL string) (res string) {
-	res = fmt.Sprintf("%s pushed %d commit", username, numCommits)
-	if numCommits != 1 {
+func formatLabels(labels []string) string {
+	res := "label"
+	if len(labels) != 1 {
 		res += "s"
 	}
-	res += fmt.Sprintf(" to %s %s:\n", repo, branch)
-	for _, msg := range messages {
-		res += fmt.Sprintf("- `%s`\n", formatCommitString(msg, 50))
-	}
-
-	res += fmt.Sprintf("\n%s", commitURL)
-	return res
+	return res + " " + strings.Join(quoteLabels(labels), ", ")
 }
 
-func FormatCreateMsg(ref string, refType string, repo string) string {
-	return fmt.Sprintf("Created new %s %s in repo %s", refType, ref, repo)
+func quoteLabels(labels []string) []string {
+	quoted := make([]string, 0, len(labels))
+	for _, label := range labels {
+		quoted = append(quoted, formatCode(label))
+	}
+	return quoted
 }
 
-func FormatDeleteMsg(ref string, refType string, repo string) string {
-	return fmt.Sprintf("Deleted %s %s in repo %s", refType, ref, repo)
+// StatusCard is the current state of an issue or pull request, and the data of
+// the "card" template. It's posted once per conversation and edited in place as
+// the item changes.
+type StatusCard struct {
+	// Kind is "issue" or "PR"
+	Kind      string
+	Repo      string
+	Index     int64
+	Title     string
+	State     string
+	Author    string
+	Source    string
+	Assignees []string
+	Labels    []string
+	Milestone string
+	URL       string
 }
 
-func FormatForkMsg(original string, newFork string) string {
-	return fmt.Sprintf("%s has been forked to %s", original, newFork)
+// itemState returns "merged" for merged pull requests, and the issue state
+// ("open" or "closed") otherwise.
+func itemState(state gitea.StateType, merged bool) string {
+	if merged {
+		return "merged"
+	}
+	return string(state)
 }
 
-func FormatIssueMsg(action gitea.HookIssueAction, username string, issueNum int64, repo string, assignee string, title string, issueURL string) (message string) {
-	// We intentionally don't handle every issue action here
-	switch action {
-	case gitea.HookIssueOpened, gitea.HookIssueClosed, gitea.HookIssueReOpened, gitea.HookIssueEdited:
-		message = fmt.Sprintf("%s %s issue \"%s\" (#%d) on %s: %s", username, action, title, issueNum, repo, issueURL)
-	case gitea.HookIssueAssigned:
-		message = fmt.Sprintf("%s %s issue \"%s\" (#%d) on %s to %s: %s", username, action, title, issueNum, repo, assignee, issueURL)
-	default:
-		message = fmt.Sprintf("%s %s issue #%d", username, action, issueNum)
+// formatExcerpt trims text to at most maxLen characters, cutting at a word
+// boundary where possible.
+func formatExcerpt(text string, maxLen int) string {
+	if maxLen < 0 {
+		maxLen = 0
 	}
-
-	return message
+	text = strings.TrimSpace(text)
+	runes := []rune(text)
+	if len(runes) <= maxLen {
+		return text
+	}
+	excerpt := string(runes[:maxLen])
+	if i := strings.LastIndexAny(excerpt, " \n"); i > maxLen/2 {
+		excerpt = excerpt[:i]
+	}
+	return strings.TrimSpace(excerpt) + "..."
 }
 
-func FormatIssueCommentMsg(action gitea.HookIssueCommentAction, username string, issueNum int64, repo string, comment string, issueTitle string, commentURL string) (message string) {
-	switch action {
-	case gitea.HookIssueCommentCreated:
-		message = fmt.Sprintf("%s commented on issue \"%s\" (#%d) on %s:\n%s\n%s", username, issueTitle, issueNum, repo, comment, commentURL)
-	case gitea.HookIssueCommentDeleted:
-		message = fmt.Sprintf("%s deleted their comment on issue \"%s\" (#%d) on %s:\n%s", username, issueTitle, issueNum, repo, comment)
-	case gitea.HookIssueCommentEdited:
-		message = fmt.Sprintf("%s edited their comment on issue \"%s\" (#%d) on %s:\n%s\n%s", username, issueTitle, issueNum, repo, comment, commentURL)
-	}
+var (
+	htmlCommentRegexp = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTagRegexp     = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9-]*(\s[^<>]*)?/?>`)
+	codeSpanRegexp    = regexp.MustCompile("`[^`\n]+`")
+	blankLinesRegexp  = regexp.MustCompile(`\n\s*\n(\s*\n)+`)
+)
 
-	return message
+// stripBody removes what isn't worth posting from a comment or issue body: the
+// quoted text of replies, HTML comments (like the hints left in issue
+// templates) and HTML tags. Code blocks and code spans are left alone, since
+// something like List<String> in them isn't HTML.
+func stripBody(text string) string {
+	var lines, prose []string
+	flush := func() {
+		if len(prose) > 0 {
+			lines = append(lines, stripProse(strings.Join(prose, "\n")))
+			prose = nil
+		}
+	}
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		isFence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+		if !inFence && !isFence {
+			prose = append(prose, line)
+			continue
+		}
+		flush()
+		if isFence {
+			inFence = !inFence
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	text = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLinesRegexp.ReplaceAllString(text, "\n\n"))
 }
 
-func FormatRepositoryMsg(action gitea.HookRepoAction, username string, repo string) (message string) {
-	switch action {
-	case gitea.HookRepoCreated, gitea.HookRepoDeleted:
-		message = fmt.Sprintf("%s %s repository %s", username, action, repo)
+// stripProse does the work of stripBody on text outside of code blocks.
+func stripProse(text string) string {
+	text = htmlCommentRegexp.ReplaceAllString(text, "")
+	var stripped strings.Builder
+	prev := 0
+	for _, span := range codeSpanRegexp.FindAllStringIndex(text, -1) {
+		stripped.WriteString(stripHTML(text[prev:span[0]]))
+		stripped.WriteString(text[span[0]:span[1]])
+		prev = span[1]
 	}
+	stripped.WriteString(stripHTML(text[prev:]))
 
-	return message
-}
-
-func FormatReleaseMsg(action gitea.HookReleaseAction, username string, repo string, release string, tag string, tarURL string) (message string) {
-	switch action {
-	case gitea.HookReleasePublished, gitea.HookReleaseUpdated:
-		message = fmt.Sprintf("%s %s release \"%s\" (%s) in %s: %s", username, action, release, tag, repo, tarURL)
-	case gitea.HookReleaseDeleted:
-		message = fmt.Sprintf("%s %s release \"%s\" (%s) in %s", username, action, release, tag, repo)
+	var lines []string
+	for _, line := range strings.Split(stripped.String(), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), ">") {
+			lines = append(lines, line)
+		}
 	}
+	return strings.Join(lines, "\n")
+}
 
-	return message
+func stripHTML(text string) string {
+	return html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, ""))
 }
 
-func FormatPullRequestMsg(action gitea.HookIssueAction, username string, repo string, prNum int64, title string, sourceBranch string, assignee string, URL string) (message string) {
-	// We intentionally don't handle every action here
-	// Note that PRs use "issue actions"
-	switch action {
-	case gitea.HookIssueOpened, gitea.HookIssueClosed, gitea.HookIssueReOpened, gitea.HookIssueEdited:
-		message = fmt.Sprintf("%s %s PR \"%s\" (#%d) on %s from source %s: %s", username, action, title, prNum, repo, sourceBranch, URL)
-	case gitea.HookIssueAssigned:
-		message = fmt.Sprintf("%s %s PR \"%s\" (#%d) on %s to %s: %s", username, action, title, prNum, repo, assignee, URL)
-	default:
-		message = fmt.Sprintf("%s %s PR #%d", username, action, prNum)
+// formatSummary escapes the stripped text, cut to maxLen characters, followed
+// by link. If the text was cut, link is added as a link to read the rest.
+func formatSummary(text string, link string, maxLen int) string {
+	text = stripBody(text)
+	if text == "" {
+		return link
 	}
+	excerpt := formatExcerpt(text, maxLen)
+	if excerpt == text {
+		res := EscapeMarkdown(text)
+		if link != "" {
+			res += "\n" + link
+		}
+		return res
+	}
+	res := EscapeMarkdown(strings.TrimSuffix(excerpt, "...")) + "…"
+	if link != "" {
+		res += " read more: " + link
+	}
+	return res
+}
 
-	return message
-}
\ No newline at end of file
+// maxMessageLength is the most bytes Keybase accepts in a chat message.
+const maxMessageLength = 10000
+
+// capMessage cuts text to fit in a chat message.
+func capMessage(text string) string {
+	if len(text) <= maxMessageLength {
+		return text
+	}
+	const ellipsis = "…"
+	cut := maxMessageLength - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + ellipsis
+}
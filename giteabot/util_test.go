@@ -0,0 +1,67 @@
+package giteabot
+
+import "testing"
+
+func TestStripBody(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "looks good", "looks good"},
+		{"html", "<p>looks <b>good</b> &amp; done</p>", "looks good & done"},
+		{"html comment", "<!-- describe the bug -->\nit crashes", "it crashes"},
+		{"quoted reply", "> did you try?\nyes", "yes"},
+		{"code span", "returns `List<String>` now", "returns `List<String>` now"},
+		{"code span and html", "<b>fix</b> `<init>` &amp; `a &amp; b`", "fix `<init>` & `a &amp; b`"},
+		{"code block", "see:\n```java\nnew ArrayList<String>();\n> not a quote\n```\n<i>done</i>",
+			"see:\n```java\nnew ArrayList<String>();\n> not a quote\n```\ndone"},
+		{"tilde code block", "~~~\n<init>\n~~~", "~~~\n<init>\n~~~"},
+		{"unclosed code block", "```\n<init>", "```\n<init>"},
+		{"blank lines", "a\n\n\n\nb", "a\n\nb"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stripBody(test.in); got != test.want {
+				t.Errorf("stripBody(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatExcerpt(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		maxLen int
+		want   string
+	}{
+		{"short", "hello", 10, "hello"},
+		{"cut at a space", "hello there world", 14, "hello there..."},
+		{"zero", "hello", 0, "..."},
+		{"negative", "hello", -1, "..."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatExcerpt(test.in, test.maxLen); got != test.want {
+				t.Errorf("formatExcerpt(%q, %d) = %q, want %q", test.in, test.maxLen, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"bot.internal:8080", "http://bot.internal:8080/giteabot/webhook"},
+		{"http://bot.internal:8080", "http://bot.internal:8080/giteabot/webhook"},
+		{"https://bot.example.com/", "https://bot.example.com/giteabot/webhook"},
+	}
+	for _, test := range tests {
+		if got := webhookURL(test.in); got != test.want {
+			t.Errorf("webhookURL(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -21,7 +22,17 @@ type Options struct {
 	*base.Options
 	HTTPPrefix    string
 	WebhookSecret string
+	LegacySecret  bool
 	GiteaURL      string
+	GiteaToken    string
+
+	DeliveryWorkers     int
+	MaxDeliveryAttempts int
+	DedupWindow         time.Duration
+	ForwardUnknown      bool
+	PushDebounce        time.Duration
+	TemplateDir         string
+	MaxBodyLength       int
 }
 
 const backs = "```"
@@ -72,9 +83,48 @@ func (s *BotServer) getConfig() (webhookSecret string, err error) {
 
 func (s *BotServer) makeAdvertisement() kbchat.Advertisement {
 	subExtended := fmt.Sprintf(`Enables posting updates from the provided Gitea project to this conversation.
+Use owner/* or owner/prefix-* to follow every matching repository of an organization, including new ones.
+Use --events to only post some kinds of events, and --branches to only post pushes, creates and deletes on matching branches (prefix a glob with ! to exclude it). Use --labels to only post label changes that apply one of the given labels. Run the command again to change them later.
+
+Examples:%s
+!gitea subscribe vlad/Managed-Qubes
+!gitea subscribe vlad/Managed-Qubes --events push,pull_request,release
+!gitea subscribe myorg/*
+!gitea subscribe vlad/Managed-Qubes --branches main,release/*,!wip/*
+!gitea subscribe vlad/Managed-Qubes --labels priority/critical
+!gitea subscribe vlad/Managed-Qubes --events wiki
+!gitea subscribe myorg/* --events package
+!gitea subscribe vlad/Managed-Qubes --events all --branches all%s`,
+		backs, backs)
+
+	replayExtended := fmt.Sprintf(`Lets a webhook delivery that was already posted here be posted again when it is redelivered from Gitea. The delivery ID is shown under "Recent Deliveries" in the webhook settings.
 
 Example:%s
-!gitea subscribe vlad/Managed-Qubes%s`,
+!gitea replay 0d5ec3c5-a69b-4a6c-a0a5-5dea5c5e6b16%s`,
+		backs, backs)
+
+	tokenExtended := fmt.Sprintf(`Gives me a Gitea access token, so I can set up webhooks for your subscriptions myself. Only send this in a direct message to me. Generate one under Settings > Applications in Gitea.
+
+Examples:%s
+!gitea token 0123456789abcdef0123456789abcdef01234567
+!gitea token forget%s`,
+		backs, backs)
+
+	styleExtended := fmt.Sprintf(`Sets how much detail I post in this conversation. Compact messages fit on a line or two, normal ones include comments and commit summaries, and verbose ones include full comments, commit messages and the files each commit touched.
+
+Examples:%s
+!gitea style
+!gitea style compact
+!gitea style verbose%s`,
+		backs, backs)
+
+	templateExtended := fmt.Sprintf(`Changes how I word a kind of message in this conversation, with a Go text/template. Run it without arguments to list the templates, with just a name to see one, or with reset to go back to the default. See the README for the fields each template gets.
+
+Examples:%s
+!gitea template
+!gitea template push
+!gitea template fork {{.Repo}} was forked to {{.Fork}} 🍴
+!gitea template push reset%s`,
 		backs, backs)
 
 	unsubExtended := fmt.Sprintf(`Disables updates from the provided Gitea project to this conversation.
@@ -88,7 +138,7 @@ Example:%s
 			Name:        "gitea subscribe",
 			Description: "Enable updates from Gitea projects",
 			ExtendedDescription: &chat1.UserBotExtendedDescription{
-				Title:       `*!gitea subscribe* <username/project>`,
+				Title:       `*!gitea subscribe* <username/project> [--events <event,...>] [--branches <glob,...>] [--labels <label,...>]`,
 				DesktopBody: subExtended,
 				MobileBody:  subExtended,
 			},
@@ -102,9 +152,45 @@ Example:%s
 				MobileBody:  unsubExtended,
 			},
 		},
+		{
+			Name:        "gitea token",
+			Description: "Let me set up Gitea webhooks for you",
+			ExtendedDescription: &chat1.UserBotExtendedDescription{
+				Title:       `*!gitea token* <token|forget>`,
+				DesktopBody: tokenExtended,
+				MobileBody:  tokenExtended,
+			},
+		},
+		{
+			Name:        "gitea replay",
+			Description: "Allow a Gitea webhook delivery to be posted again",
+			ExtendedDescription: &chat1.UserBotExtendedDescription{
+				Title:       `*!gitea replay* <delivery ID>`,
+				DesktopBody: replayExtended,
+				MobileBody:  replayExtended,
+			},
+		},
+		{
+			Name:        "gitea style",
+			Description: "Choose compact, normal or verbose updates here",
+			ExtendedDescription: &chat1.UserBotExtendedDescription{
+				Title:       `*!gitea style* [compact|normal|verbose]`,
+				DesktopBody: styleExtended,
+				MobileBody:  styleExtended,
+			},
+		},
+		{
+			Name:        "gitea template",
+			Description: "Change how updates are worded here",
+			ExtendedDescription: &chat1.UserBotExtendedDescription{
+				Title:       `*!gitea template* [<name> [<template>|reset]]`,
+				DesktopBody: templateExtended,
+				MobileBody:  templateExtended,
+			},
+		},
 		{
 			Name:        "gitea list",
-			Description: "Lists all your subscriptions.",
+			Description: "Lists all your subscriptions and the events they post.",
 		},
 	}
 	return kbchat.Advertisement{
@@ -153,13 +239,23 @@ func (s *BotServer) Go() (err error) {
 	}
 	stats = stats.SetPrefix(s.Name())
 
-	handler := giteabot.NewHandler(stats, s.kbc, debugConfig, db, s.opts.HTTPPrefix, secret, s.opts.GiteaURL)
-	httpSrv := giteabot.NewHTTPSrv(stats, s.kbc, debugConfig, db, handler, secret)
+	templates, err := giteabot.NewTemplates(db, s.opts.TemplateDir, s.opts.MaxBodyLength)
+	if err != nil {
+		s.Errorf("failed to load templates: %s", err)
+		return err
+	}
+
+	handler := giteabot.NewHandler(stats, s.kbc, debugConfig, db, templates, s.opts.HTTPPrefix, secret, s.opts.GiteaURL, s.opts.GiteaToken)
+	queue := giteabot.NewDeliveryQueue(stats, s.kbc, debugConfig, db, handler, templates, s.opts.DeliveryWorkers, s.opts.MaxDeliveryAttempts)
+	debouncer := giteabot.NewPushDebouncer(debugConfig, db, queue, templates, s.opts.PushDebounce, s.opts.DedupWindow)
+	httpSrv := giteabot.NewHTTPSrv(stats, s.kbc, debugConfig, db, handler, queue, debouncer, templates, secret, s.opts.LegacySecret,
+		s.opts.DedupWindow, s.opts.ForwardUnknown)
 
 	eg := &errgroup.Group{}
 	s.GoWithRecover(eg, func() error { return s.Listen(handler) })
 	s.GoWithRecover(eg, httpSrv.Listen)
-	s.GoWithRecover(eg, func() error { return s.HandleSignals(httpSrv) })
+	s.GoWithRecover(eg, queue.Listen)
+	s.GoWithRecover(eg, func() error { return s.HandleSignals(httpSrv, debouncer, queue) })
 	if err := eg.Wait(); err != nil {
 		s.Debug("wait error: %s", err)
 		return err
@@ -176,9 +272,18 @@ func mainInner() int {
 	opts := NewOptions()
 
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	fs.StringVar(&opts.HTTPPrefix, "http-prefix", os.Getenv("BOT_HTTP_PREFIX"), "host:port of bot's HTTP server listening for incoming webhooks")
+	fs.StringVar(&opts.HTTPPrefix, "http-prefix", os.Getenv("BOT_HTTP_PREFIX"), "host:port (or URL, e.g. https://host) of bot's HTTP server listening for incoming webhooks")
 	fs.StringVar(&opts.WebhookSecret, "secret", os.Getenv("BOT_WEBHOOK_SECRET"), "Webhook secret")
+	fs.StringVar(&opts.GiteaToken, "gitea-token", os.Getenv("BOT_GITEA_TOKEN"), "Gitea API token used to set up webhooks, if the subscriber hasn't given their own")
+	fs.BoolVar(&opts.LegacySecret, "legacy-secret", os.Getenv("BOT_LEGACY_SECRET") == "true", "Accept unsigned webhooks carrying the secret in the payload (Gitea < 1.9)")
 	fs.StringVar(&opts.GiteaURL, "gitea-url", os.Getenv("BOT_GITEA_URL"), "URL of the Gitea server, for pretty links in announcements")
+	fs.IntVar(&opts.DeliveryWorkers, "delivery-workers", 4, "Number of conversations to send queued messages to at once")
+	fs.IntVar(&opts.MaxDeliveryAttempts, "max-delivery-attempts", 10, "Attempts at sending a message before it is dead-lettered")
+	fs.DurationVar(&opts.DedupWindow, "dedup-window", 24*time.Hour, "Ignore redeliveries of the same X-Gitea-Delivery within this window, 0 to disable")
+	fs.BoolVar(&opts.ForwardUnknown, "forward-unknown-events", os.Getenv("BOT_FORWARD_UNKNOWN_EVENTS") == "true", "Post a generic summary of unsupported event types to subscriptions that want all events")
+	fs.DurationVar(&opts.PushDebounce, "push-debounce", 0, "Combine pushes to the same branch within this window into one message, 0 to disable")
+	fs.StringVar(&opts.TemplateDir, "template-dir", os.Getenv("BOT_TEMPLATE_DIR"), "Directory of <name>.tmpl files overriding the default message templates")
+	fs.IntVar(&opts.MaxBodyLength, "max-body-length", 500, "Characters of a comment to post before cutting it off with a link to the rest")
 	showVersion := fs.Bool("version", false, "display the version and quit")
 
 	if err := opts.Parse(fs, os.Args); err != nil {
@@ -197,6 +302,12 @@ func mainInner() int {
 		return 3
 	}
 
+	if opts.MaxBodyLength <= 0 {
+		fmt.Printf("--max-body-length must be positive, got %d\n\n", opts.MaxBodyLength)
+		fs.PrintDefaults()
+		return 3
+	}
+
 	bs := NewBotServer(*opts)
 	if err := bs.Go(); err != nil {
 		fmt.Printf("error running chat loop: %s\n", err)